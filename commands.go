@@ -0,0 +1,539 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+	"github.com/zhoucq/airflow-db-cleaner/internal/service"
+)
+
+// options holds the flags shared by the commands
+type options struct {
+	configPath  string
+	dryRun      bool
+	tables      string
+	batchSize   int
+	forceSchema bool
+}
+
+// environment holds what the commands work with
+type environment struct {
+	config  *service.AppConfig
+	schema  *service.SchemaVersion
+	db      *database.DB
+	cleaner *service.Cleaner
+	logFile *os.File
+}
+
+// newFlagSet creates the flag set of a command with the shared flags
+func newFlagSet(name string, opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.StringVar(&opts.configPath, "config", "config/config.yaml", "Configuration file path")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "Only show what would be done, overrides cleaner.dry_run")
+	fs.StringVar(&opts.tables, "tables", "", "Comma-separated list of tables to process, overrides the enabled tables")
+	fs.IntVar(&opts.batchSize, "batch-size", 0, "Number of records processed per batch, overrides cleaner.batch_size")
+	fs.BoolVar(&opts.forceSchema, "force-schema", false, "Run against a schema revision not matching a known Airflow version")
+	return fs
+}
+
+// loadConfig loads the configuration file and applies the flag overrides
+func loadConfig(fs *flag.FlagSet, opts *options) (*service.AppConfig, error) {
+	// Ensure the configuration file path is absolute
+	absConfigPath, err := filepath.Abs(opts.configPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get absolute path of configuration file: %w", err)
+	}
+
+	// Check if file exists
+	if _, err := os.Stat(absConfigPath); os.IsNotExist(err) {
+		return nil, fmt.Errorf("configuration file does not exist: %s", absConfigPath)
+	}
+
+	// Load configuration
+	config, err := service.LoadConfig(absConfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	// Apply the flags given on the command line
+	var overrideErr error
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dry-run":
+			config.Cleaner.DryRun = opts.dryRun
+		case "batch-size":
+			if opts.batchSize <= 0 {
+				overrideErr = fmt.Errorf("batch size must be greater than 0")
+			}
+			config.Cleaner.BatchSize = opts.batchSize
+		case "tables":
+			if err := config.SelectTables(splitList(opts.tables)); err != nil {
+				overrideErr = err
+			}
+		}
+	})
+	if overrideErr != nil {
+		return nil, overrideErr
+	}
+
+	return config, nil
+}
+
+// setup loads the configuration, sets up logging and connects to the database
+func setup(fs *flag.FlagSet, opts *options) (*environment, error) {
+	config, err := loadConfig(fs, opts)
+	if err != nil {
+		return nil, err
+	}
+	env := &environment{config: config}
+
+	// Set log according to configuration
+	if config.Log.File != "" {
+		env.logFile, err = os.OpenFile(config.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open log file: %w", err)
+		}
+		log.SetOutput(env.logFile)
+	}
+
+	// Connect to database
+	env.db, err = database.New(config.GetDatabaseConfig())
+	if err != nil {
+		env.Close()
+		return nil, fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	// Detect the Airflow version to choose the tables, date columns and primary keys; a
+	// configured preset is used even when the version is unknown
+	force := opts.forceSchema || config.Cleaner.Preset != service.PresetAuto
+	env.schema, err = service.DetectSchema(env.db, force)
+	if err == nil {
+		err = config.UseSchema(env.schema)
+	}
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+
+	// Create cleaner
+	env.cleaner = service.NewCleaner(env.db, config.GetCleanerConfig())
+	return env, nil
+}
+
+// Close closes the database connection and the log file
+func (env *environment) Close() {
+	if env.db != nil {
+		env.db.Close()
+	}
+	if env.logFile != nil {
+		env.logFile.Close()
+	}
+}
+
+// methodDescriptions describes the deletion methods of the tables
+var methodDescriptions = map[string]string{
+	service.MethodDeleteLimit: "Direct DELETE, simpler but may be slower for large tables",
+	service.MethodPrimaryKey:  "Primary key-based deletion, faster for large tables but with more queries",
+	models.StrategyRunCascade: "Expired DAG runs with all their dependent records",
+	models.StrategyPKRange:    "Primary key ranges",
+	models.StrategyDateWindow: "Date windows, oldest first",
+	models.StrategyCopySwap:   "Copy of the records to keep swapped with the table",
+}
+
+// runCommand cleans the expired records
+func runCommand(args []string) error {
+	var opts options
+	fs := newFlagSet("run", &opts)
+	fs.Parse(args)
+
+	env, err := setup(fs, &opts)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	config := env.config
+
+	// Print run mode
+	fmt.Printf("=== Metadata database: %s, %s preset ===\n", env.schema, config.Cleaner.Preset)
+	if config.Cleaner.DryRun {
+		fmt.Println("=== Running in Dry Run mode ===")
+		fmt.Println("No actual deletion operations will be executed, only showing the number of records to be deleted")
+	} else {
+		fmt.Println("=== Running in Execution mode ===")
+		fmt.Println("Actual deletion operations will be executed, please ensure important data has been backed up")
+	}
+
+	// Print the deletion method of the enabled tables, grouped by method
+	var methods []string
+	methodTables := make(map[string][]string)
+	for _, table := range config.GetCleanerConfig().Tables {
+		if !table.Enabled {
+			continue
+		}
+		method := env.cleaner.DeletionMethod(table)
+		if methodTables[method] == nil {
+			methods = append(methods, method)
+		}
+		methodTables[method] = append(methodTables[method], table.TableName)
+	}
+	fmt.Println("\n=== Deletion methods ===")
+	for _, method := range methods {
+		description := methodDescriptions[method]
+		if method == service.MethodPrimaryKey && !config.Cleaner.UsePrimaryKeyDelete {
+			description = "Primary key-based deletion, needed to archive the deleted records"
+		}
+		fmt.Printf("%s: %s\n", description, strings.Join(methodTables[method], ", "))
+	}
+
+	fmt.Println("\n=== Starting to clean expired data ===")
+
+	// Execute cleaning
+	if err := env.cleaner.CleanAll(); err != nil {
+		return fmt.Errorf("failed to clean data: %w", err)
+	}
+
+	fmt.Println("=== Data cleaning completed ===")
+	return nil
+}
+
+// planCommand reports the number of records that would be cleaned
+func planCommand(args []string) error {
+	var opts options
+	fs := newFlagSet("plan", &opts)
+	fs.Parse(args)
+
+	env, err := setup(fs, &opts)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	plans, err := env.cleaner.Plan()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("=== Cleaning plan (dry run, nothing is deleted) ===")
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tDAGS\tSTATE\tRETENTION\tCUTOFF\tRECORDS TO CLEAN\tNOTE")
+	var total int
+	for _, plan := range plans {
+		if plan.Skipped != "" {
+			fmt.Fprintf(w, "%s\t\t\t\t%s\t%d\t%s\n", plan.Table, plan.Cutoff.Format("2006-01-02 15:04"), plan.Count, plan.Skipped)
+			continue
+		}
+		// Break the count down by the dag_id override and state that matched
+		for _, scope := range plan.Scopes {
+			dags, state := scope.Override, scope.State
+			if dags == "" {
+				dags = "*"
+			}
+			if state == "" {
+				state = "*"
+			}
+			note := ""
+			if scope.FallbackCount > 0 {
+				note = fmt.Sprintf("%d by fallback date", scope.FallbackCount)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%dd\t%s\t%d\t%s\n", plan.Table, dags, state, scope.RetentionDays, scope.Cutoff.Format("2006-01-02 15:04"), scope.Count, note)
+		}
+		total += plan.Count
+
+		// Zombie jobs are only deleted with the delete action, otherwise they are failed
+		if zombies := plan.Zombies; zombies != nil {
+			fmt.Fprintf(w, "%s\t*\trunning\t-\t%s\t%d\tzombie jobs to %s\n", plan.Table, zombies.Cutoff.Format("2006-01-02 15:04"), zombies.Count, zombies.Action)
+			if zombies.Action == models.ZombieActionDelete {
+				total += zombies.Count
+			}
+		}
+
+		// Records of other tables deleted by cascade are reported separately
+		for _, cascade := range plan.Cascades {
+			fmt.Fprintf(w, "%s\t\t\t\t\t%d\tcascade from %s\n", cascade.Table, cascade.Count, cascade.Parent)
+			total += cascade.Count
+		}
+	}
+	fmt.Fprintf(w, "TOTAL\t\t\t\t\t%d\t\n", total)
+	return w.Flush()
+}
+
+// statsCommand reports table sizes and the age distribution of records
+func statsCommand(args []string) error {
+	var opts options
+	fs := newFlagSet("stats", &opts)
+	fs.Parse(args)
+
+	env, err := setup(fs, &opts)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	stats, err := env.cleaner.Stats()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	header := []string{"TABLE", "SIZE", "ROWS", "EXPIRED"}
+	lower := 0
+	for _, days := range service.AgeBuckets {
+		header = append(header, fmt.Sprintf("%d-%dd", lower, days))
+		lower = days
+	}
+	header = append(header, fmt.Sprintf(">%dd", lower), "NO DATE", "OLDEST", "")
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+
+	for _, s := range stats {
+		if s.Skipped != "" {
+			row := []string{s.Table}
+			for len(row) < len(header)-1 {
+				row = append(row, "-")
+			}
+			fmt.Fprintln(w, strings.Join(append(row, "  "+s.Skipped), "\t"))
+			continue
+		}
+		row := []string{s.Table, formatSize(s.SizeBytes), fmt.Sprint(s.Rows), fmt.Sprint(s.Expired)}
+		for _, count := range s.Buckets {
+			row = append(row, fmt.Sprint(count))
+		}
+		oldest := "-"
+		if !s.Oldest.IsZero() {
+			oldest = s.Oldest.Format("2006-01-02")
+		}
+		row = append(row, fmt.Sprint(s.NullDates), oldest, "")
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	return w.Flush()
+}
+
+// validateCommand checks the configuration and the database schema
+func validateCommand(args []string) error {
+	var opts options
+	fs := newFlagSet("validate", &opts)
+	fs.Parse(args)
+
+	env, err := setup(fs, &opts)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+	fmt.Println("Configuration is valid")
+
+	problems, err := env.cleaner.Validate()
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		fmt.Println("Schema problems:")
+		for _, problem := range problems {
+			fmt.Printf("  - %s\n", problem)
+		}
+		return fmt.Errorf("found %d schema problems", len(problems))
+	}
+
+	fmt.Println("Database schema matches the configured tables")
+	return nil
+}
+
+// schemaCheckCommand reports the differences between the table models and the live schema
+func schemaCheckCommand(args []string) error {
+	var opts options
+	fs := newFlagSet("schema-check", &opts)
+	fs.Parse(args)
+
+	env, err := setup(fs, &opts)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	// The models describe the Airflow 2 tables, an Airflow 3 schema would only show differences
+	if env.schema.Preset != service.ModelPreset {
+		fmt.Printf("The table models describe the %s schema, skipping the comparison with %s (%s preset)\n",
+			service.ModelPreset, env.schema, env.schema.Preset)
+		return nil
+	}
+
+	drifts, err := env.cleaner.SchemaCheck()
+	if err != nil {
+		return err
+	}
+	if len(drifts) == 0 {
+		fmt.Println("Database schema matches the table models")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tCOLUMN\tCHANGE\tMODEL\tDATABASE")
+	for _, d := range drifts {
+		column := d.Column
+		if column == "" {
+			column = "*"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Table, column, d.Kind, orDash(d.Model), orDash(d.Database))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return fmt.Errorf("found %d schema differences", len(drifts))
+}
+
+// archivesCommand lists or drops the archive tables
+func archivesCommand(args []string) error {
+	action := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+	if action != "list" && action != "drop" {
+		return fmt.Errorf("unknown archives action %q, expected list or drop", action)
+	}
+
+	var opts options
+	fs := newFlagSet("archives", &opts)
+	olderThan := fs.Duration("older-than", 30*24*time.Hour, "With drop, drop archive tables older than this age")
+	fs.Parse(args)
+
+	env, err := setup(fs, &opts)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	switch action {
+	case "list":
+		archives, err := env.cleaner.ListArchiveTables()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("=== %d archive tables ===\n", len(archives))
+		for _, archive := range archives {
+			fmt.Printf("%s\t%s\t%s\n", archive.Name, archive.Table, archive.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+		}
+		return nil
+	default:
+		dropped, err := env.cleaner.DropArchiveTables(*olderThan)
+		if err != nil {
+			return err
+		}
+		if env.config.Cleaner.DryRun {
+			fmt.Printf("=== Dry run: %d archive tables older than %s would be dropped ===\n", len(dropped), *olderThan)
+		} else {
+			fmt.Printf("=== %d archive tables older than %s dropped ===\n", len(dropped), *olderThan)
+		}
+		for _, archive := range dropped {
+			fmt.Println(archive.Name)
+		}
+	}
+	return nil
+}
+
+// restoreCommand restores archived records
+func restoreCommand(args []string) error {
+	source := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		source, args = args[0], args[1:]
+	}
+
+	var opts options
+	fs := newFlagSet("restore", &opts)
+	table := fs.String("table", "", "Table to restore into, derived from the archive name by default")
+	dagID := fs.String("dag-id", "", "Only restore records of this DAG")
+	from := fs.String("from", "", "Only restore records dated at or after this date (YYYY-MM-DD in UTC or RFC 3339)")
+	to := fs.String("to", "", "Only restore records dated before this date (YYYY-MM-DD in UTC or RFC 3339)")
+	fs.Parse(args)
+	if source == "" {
+		source = fs.Arg(0)
+	}
+	if source == "" {
+		return fmt.Errorf("archive file or table not specified")
+	}
+
+	restoreOpts := service.RestoreOptions{Source: source, Table: *table, DagID: *dagID}
+	var err error
+	if restoreOpts.From, err = parseDate(*from); err != nil {
+		return fmt.Errorf("invalid -from date: %w", err)
+	}
+	if restoreOpts.To, err = parseDate(*to); err != nil {
+		return fmt.Errorf("invalid -to date: %w", err)
+	}
+
+	env, err := setup(fs, &opts)
+	if err != nil {
+		return err
+	}
+	defer env.Close()
+
+	result, err := env.cleaner.Restore(restoreOpts)
+	if err != nil {
+		return fmt.Errorf("failed to restore records: %w", err)
+	}
+	if env.config.Cleaner.DryRun {
+		fmt.Printf("=== Dry run: %d of %d archived records would be restored to table %s, %d conflicting records skipped ===\n",
+			result.Restored, result.Read, result.Table, result.Conflicts)
+	} else {
+		fmt.Printf("=== %d of %d archived records restored to table %s, %d conflicting records skipped ===\n",
+			result.Restored, result.Read, result.Table, result.Conflicts)
+	}
+	return nil
+}
+
+// versionCommand prints the version
+func versionCommand(args []string) error {
+	fmt.Printf("airflow-db-cleaner %s\n", version)
+	return nil
+}
+
+// parseDate parses a YYYY-MM-DD date in UTC, like the dates Airflow stores, or an RFC 3339
+// date, returning the zero time when empty
+func parseDate(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.UTC); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// orDash returns the value, or "-" when it is empty
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+// splitList splits a comma-separated list, ignoring empty items
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// formatSize formats a size in bytes for humans
+func formatSize(size int64) string {
+	if size < 0 {
+		return "-"
+	}
+	units := []string{"B", "KB", "MB", "GB", "TB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%s", value, units[unit])
+}
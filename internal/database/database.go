@@ -4,19 +4,26 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
 )
 
 // Config database configuration
 type Config struct {
+	Driver          string // mysql, postgres or sqlite, defaults to mysql
 	Host            string
 	Port            int
 	User            string
 	Password        string
 	Name            string
+	Schema          string // PostgreSQL schema, defaults to the server search_path
+	SSLMode         string // PostgreSQL sslmode, defaults to disable
+	Path            string // SQLite database file path
 	MaxIdleConns    int
 	MaxOpenConns    int
 	ConnMaxLifetime time.Duration
@@ -26,7 +33,8 @@ type Config struct {
 // DB encapsulates database connection
 type DB struct {
 	*sqlx.DB
-	mock bool
+	mock    bool
+	dialect Dialect
 }
 
 // MockDB is a mock database implementation
@@ -36,25 +44,25 @@ type MockDB struct {
 
 // New creates a database connection
 func New(config Config) (*DB, error) {
+	dialect, err := GetDialect(config.Driver)
+	if err != nil {
+		return nil, err
+	}
+
 	// If in mock mode, return a mock database implementation
 	if config.Mock {
 		log.Printf("Using mock mode, not actually connecting to the database")
-		return &DB{nil, true}, nil
+		return &DB{nil, true, dialect}, nil
 	}
 
-	// Build DSN connection string
-	var dsn string
-	if config.Password == "" {
-		// Empty password
-		dsn = fmt.Sprintf("%s@tcp(%s:%d)/%s?parseTime=true&loc=Local",
-			config.User, config.Host, config.Port, config.Name)
-	} else {
-		// With password
-		dsn = fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=Local",
-			config.User, config.Password, config.Host, config.Port, config.Name)
+	if config.Port == 0 {
+		config.Port = dialect.DefaultPort()
 	}
 
-	db, err := sqlx.Connect("mysql", dsn)
+	// Build DSN connection string
+	dsn := dialect.DSN(config)
+
+	db, err := sqlx.Connect(dialect.DriverName(), dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
@@ -69,8 +77,181 @@ func New(config Config) (*DB, error) {
 		return nil, fmt.Errorf("failed to test database connection: %w", err)
 	}
 
-	log.Printf("Successfully connected to database %s:%d/%s", config.Host, config.Port, config.Name)
-	return &DB{db, false}, nil
+	if config.Path != "" {
+		log.Printf("Successfully connected to %s database %s", dialect.Name(), config.Path)
+	} else {
+		log.Printf("Successfully connected to %s database %s:%d/%s", dialect.Name(), config.Host, config.Port, config.Name)
+	}
+	return &DB{db, false, dialect}, nil
+}
+
+// NewWithDB wraps an existing connection, e.g. one opened with a mocked driver
+func NewWithDB(db *sql.DB, driver string) (*DB, error) {
+	dialect, err := GetDialect(driver)
+	if err != nil {
+		return nil, err
+	}
+	return &DB{sqlx.NewDb(db, dialect.DriverName()), false, dialect}, nil
+}
+
+// Dialect returns the SQL dialect of the database
+func (db *DB) Dialect() Dialect {
+	return db.dialect
+}
+
+// IsMock reports whether the database runs in mock mode
+func (db *DB) IsMock() bool {
+	return db.mock
+}
+
+// Quote quotes an identifier for the database dialect
+func (db *DB) Quote(name string) string {
+	return db.dialect.Quote(name)
+}
+
+// RowList builds the right-hand side of a row constructor IN condition for the database dialect
+func (db *DB) RowList(rows []string) string {
+	return db.dialect.RowListSQL(rows)
+}
+
+// GlobMatch builds the condition matching a column against a glob pattern for the database dialect
+func (db *DB) GlobMatch(column, pattern string) (string, interface{}) {
+	return db.dialect.GlobMatchSQL(column, pattern)
+}
+
+// TableExists checks whether a table exists
+func (db *DB) TableExists(table string) (bool, error) {
+	tables, err := db.Tables()
+	if err != nil {
+		return false, err
+	}
+	for _, name := range tables {
+		if name == table {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Tables lists the tables of the database
+func (db *DB) Tables() ([]string, error) {
+	var tables []string
+	if db.mock {
+		return tables, nil
+	}
+	if err := db.Select(&tables, db.dialect.TablesSQL()); err != nil {
+		return nil, err
+	}
+	return tables, nil
+}
+
+// TableSize returns the size in bytes of a table and its indexes, -1 when not supported
+func (db *DB) TableSize(table string) (int64, error) {
+	query := db.dialect.TableSizeSQL()
+	if query == "" {
+		return -1, nil
+	}
+	var size int64
+	if err := db.Get(&size, query, table); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// ColumnExists checks whether a table has the given column
+func (db *DB) ColumnExists(table, column string) (bool, error) {
+	var count int
+	if err := db.Get(&count, db.dialect.ColumnExistsSQL(), table, column); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Column describes a column of a table
+type Column struct {
+	Name     string
+	Type     string // Data type as reported by the database, e.g. varchar or timestamp with time zone
+	Nullable bool
+}
+
+// Columns lists the columns of a table in column order, empty when it does not exist
+func (db *DB) Columns(table string) ([]Column, error) {
+	var columns []Column
+	if db.mock {
+		return columns, nil
+	}
+
+	rows, err := db.Queryx(db.dialect.ColumnsSQL(), table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var column Column
+		var nullable string
+		if err := rows.Scan(&column.Name, &column.Type, &nullable); err != nil {
+			return nil, err
+		}
+		column.Nullable = strings.EqualFold(nullable, "YES")
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// PrimaryKey lists the primary key columns of a table in key order, empty when it has none
+func (db *DB) PrimaryKey(table string) ([]string, error) {
+	var columns []string
+	if err := db.Select(&columns, db.dialect.PrimaryKeySQL(), table); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// ForeignKey describes a foreign key constraint
+type ForeignKey struct {
+	Name              string
+	Table             string
+	Columns           []string
+	ReferencedTable   string
+	ReferencedColumns []string
+	DeleteRule        string // CASCADE, SET NULL, RESTRICT, NO ACTION...
+}
+
+// ForeignKeys lists the foreign keys of the database
+func (db *DB) ForeignKeys() ([]ForeignKey, error) {
+	var foreignKeys []ForeignKey
+	if db.mock {
+		return foreignKeys, nil
+	}
+
+	rows, err := db.Queryx(db.dialect.ForeignKeysSQL())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name, table, column, referencedTable, referencedColumn, deleteRule string
+		if err := rows.Scan(&name, &table, &column, &referencedTable, &referencedColumn, &deleteRule); err != nil {
+			return nil, err
+		}
+
+		// Columns of a constraint are listed in order on consecutive rows
+		last := len(foreignKeys) - 1
+		if last < 0 || foreignKeys[last].Name != name || foreignKeys[last].Table != table {
+			foreignKeys = append(foreignKeys, ForeignKey{
+				Name:            name,
+				Table:           table,
+				ReferencedTable: referencedTable,
+				DeleteRule:      strings.ToUpper(deleteRule),
+			})
+			last++
+		}
+		foreignKeys[last].Columns = append(foreignKeys[last].Columns, column)
+		foreignKeys[last].ReferencedColumns = append(foreignKeys[last].ReferencedColumns, referencedColumn)
+	}
+	return foreignKeys, rows.Err()
 }
 
 // Close closes the database connection
@@ -94,7 +275,7 @@ func (db *DB) Get(dest interface{}, query string, args ...interface{}) error {
 
 		return nil
 	}
-	return db.DB.Get(dest, query, args...)
+	return db.DB.Get(dest, db.Rebind(query), db.convertArgs(args)...)
 }
 
 // Select retrieves multiple records
@@ -110,7 +291,7 @@ func (db *DB) Select(dest interface{}, query string, args ...interface{}) error
 
 		return nil
 	}
-	return db.DB.Select(dest, query, args...)
+	return db.DB.Select(dest, db.Rebind(query), db.convertArgs(args)...)
 }
 
 // Exec executes SQL
@@ -119,7 +300,7 @@ func (db *DB) Exec(query string, args ...interface{}) (sql.Result, error) {
 		log.Printf("[Mock] Execute SQL: %s, args: %v", query, args)
 		return MockResult{1000}, nil
 	}
-	return db.DB.Exec(query, args...)
+	return db.DB.Exec(db.Rebind(query), db.convertArgs(args)...)
 }
 
 // Queryx queries
@@ -128,7 +309,60 @@ func (db *DB) Queryx(query string, args ...interface{}) (*sqlx.Rows, error) {
 		log.Printf("[Mock] Execute query: %s, args: %v", query, args)
 		return nil, fmt.Errorf("mock mode does not support Queryx")
 	}
-	return db.DB.Queryx(query, args...)
+	return db.DB.Queryx(db.Rebind(query), db.convertArgs(args)...)
+}
+
+// Tx encapsulates a database transaction
+type Tx struct {
+	*sqlx.Tx
+	db *DB
+}
+
+// Transaction runs fn in a transaction, committing it when fn returns nil and rolling it back otherwise
+func (db *DB) Transaction(fn func(tx *Tx) error) error {
+	if db.mock {
+		log.Printf("[Mock] Begin transaction")
+		if err := fn(&Tx{nil, db}); err != nil {
+			log.Printf("[Mock] Rollback transaction")
+			return err
+		}
+		log.Printf("[Mock] Commit transaction")
+		return nil
+	}
+
+	tx, err := db.DB.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := fn(&Tx{tx, db}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// Exec executes SQL within the transaction
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	if tx.db.mock {
+		return tx.db.Exec(query, args...)
+	}
+	return tx.Tx.Exec(tx.Rebind(query), tx.db.convertArgs(args)...)
+}
+
+// convertArgs converts query arguments for dialects that need it
+func (db *DB) convertArgs(args []interface{}) []interface{} {
+	converter, ok := db.dialect.(argConverter)
+	if !ok {
+		return args
+	}
+	converted := make([]interface{}, len(args))
+	for i, arg := range args {
+		converted[i] = converter.ConvertArg(arg)
+	}
+	return converted
 }
 
 // MockResult is a mock result
@@ -0,0 +1,97 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect encapsulates the SQL differences between database backends
+type Dialect interface {
+	// Name returns the dialect name used in the configuration
+	Name() string
+	// DriverName returns the database/sql driver name
+	DriverName() string
+	// DefaultPort returns the port used when none is configured
+	DefaultPort() int
+	// DSN builds the connection string
+	DSN(config Config) string
+	// Quote quotes an identifier
+	Quote(name string) string
+	// DeleteLimitSQL builds a statement deleting at most limit rows of table matching where
+	DeleteLimitSQL(table, where string, limit int) string
+	// RowListSQL builds the right-hand side of a row constructor IN condition from
+	// parenthesized rows, e.g. (a, b) IN ((?, ?), (?, ?))
+	RowListSQL(rows []string) string
+	// GlobMatchSQL builds a case-sensitive condition matching column against a glob pattern,
+	// where * matches any characters and ? a single character, and its argument
+	GlobMatchSQL(column, pattern string) (string, interface{})
+	// TablesSQL returns a query listing the table names of the current schema
+	TablesSQL() string
+	// TableSizeSQL returns a query for the size in bytes of a table and its indexes,
+	// taking the table name as argument, or an empty string when not supported
+	TableSizeSQL() string
+	// ColumnExistsSQL returns a query counting the columns of a table with a given name,
+	// taking the table name and column name as arguments
+	ColumnExistsSQL() string
+	// ColumnsSQL returns a query listing the columns of a table as name, data type and
+	// nullability (YES or NO), in column order, taking the table name as argument
+	ColumnsSQL() string
+	// PrimaryKeySQL returns a query listing the primary key columns of a table in key order,
+	// taking the table name as argument
+	PrimaryKeySQL() string
+	// ForeignKeysSQL returns a query listing the foreign key columns of the current schema as
+	// constraint name, table, column, referenced table, referenced column and delete rule,
+	// ordered by table, constraint and column position
+	ForeignKeysSQL() string
+}
+
+// argConverter is implemented by dialects that need query arguments converted before binding
+type argConverter interface {
+	ConvertArg(arg interface{}) interface{}
+}
+
+// dialects lists the supported dialects by configuration name
+var dialects = map[string]Dialect{
+	"mysql":      mysqlDialect{},
+	"postgres":   postgresDialect{},
+	"postgresql": postgresDialect{},
+	"sqlite":     sqliteDialect{},
+	"sqlite3":    sqliteDialect{},
+}
+
+// GetDialect returns the dialect with the given name, MySQL when empty
+func GetDialect(name string) (Dialect, error) {
+	if name == "" {
+		name = "mysql"
+	}
+	dialect, ok := dialects[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %q", name)
+	}
+	return dialect, nil
+}
+
+// quoteWith quotes an identifier with the given quote character, doubling embedded quotes
+func quoteWith(name string, quote string) string {
+	return quote + strings.ReplaceAll(name, quote, quote+quote) + quote
+}
+
+// likeMatch matches a column against a glob pattern converted to a LIKE pattern using ! as
+// escape character
+func likeMatch(column, pattern string) (string, interface{}) {
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteRune('%')
+		case '?':
+			b.WriteRune('_')
+		case '%', '_', '!':
+			b.WriteRune('!')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return column + " LIKE ? ESCAPE '!'", b.String()
+}
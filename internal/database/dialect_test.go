@@ -0,0 +1,27 @@
+package database
+
+import "testing"
+
+func TestGlobMatchSQL(t *testing.T) {
+	tests := []struct {
+		driver    string
+		pattern   string
+		condition string
+		arg       interface{}
+	}{
+		{"mysql", "etl_*", "`dag_id` LIKE ? ESCAPE '!'", "etl!_%"},
+		{"postgres", "report?%!", `"dag_id" LIKE ? ESCAPE '!'`, "report_!%!!"},
+		{"sqlite", "etl_*", `"dag_id" GLOB ?`, "etl_*"},
+		{"sqlite", "[a]?", `"dag_id" GLOB ?`, "[[]a]?"},
+	}
+	for _, tt := range tests {
+		d, err := GetDialect(tt.driver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		condition, arg := d.GlobMatchSQL(d.Quote("dag_id"), tt.pattern)
+		if condition != tt.condition || arg != tt.arg {
+			t.Errorf("%s: GlobMatchSQL(%q) = %s, %v, expected %s, %v", tt.driver, tt.pattern, condition, arg, tt.condition, tt.arg)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mysqlDialect implements Dialect for MySQL
+type mysqlDialect struct{}
+
+// Name implements Dialect
+func (mysqlDialect) Name() string {
+	return "mysql"
+}
+
+// DriverName implements Dialect
+func (mysqlDialect) DriverName() string {
+	return "mysql"
+}
+
+// DefaultPort implements Dialect
+func (mysqlDialect) DefaultPort() int {
+	return 3306
+}
+
+// DSN implements Dialect
+func (mysqlDialect) DSN(config Config) string {
+	if config.Password == "" {
+		// Empty password
+		return fmt.Sprintf("%s@tcp(%s:%d)/%s?parseTime=true&loc=Local",
+			config.User, config.Host, config.Port, config.Name)
+	}
+	// With password
+	return fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?parseTime=true&loc=Local",
+		config.User, config.Password, config.Host, config.Port, config.Name)
+}
+
+// Quote implements Dialect
+func (mysqlDialect) Quote(name string) string {
+	return quoteWith(name, "`")
+}
+
+// DeleteLimitSQL implements Dialect
+func (d mysqlDialect) DeleteLimitSQL(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE %s LIMIT %d", d.Quote(table), where, limit)
+}
+
+// RowListSQL implements Dialect
+func (mysqlDialect) RowListSQL(rows []string) string {
+	return "(" + strings.Join(rows, ", ") + ")"
+}
+
+// GlobMatchSQL implements Dialect
+// Airflow creates the id columns with a binary collation on MySQL, so LIKE is case-sensitive.
+func (mysqlDialect) GlobMatchSQL(column, pattern string) (string, interface{}) {
+	return likeMatch(column, pattern)
+}
+
+// TablesSQL implements Dialect
+func (mysqlDialect) TablesSQL() string {
+	return `
+		SELECT table_name
+		FROM information_schema.tables
+		WHERE table_schema = DATABASE()
+		AND table_type = 'BASE TABLE'`
+}
+
+// TableSizeSQL implements Dialect
+func (mysqlDialect) TableSizeSQL() string {
+	return `
+		SELECT COALESCE(data_length + index_length, 0)
+		FROM information_schema.tables
+		WHERE table_schema = DATABASE()
+		AND table_name = ?`
+}
+
+// ColumnExistsSQL implements Dialect
+func (mysqlDialect) ColumnExistsSQL() string {
+	return `
+		SELECT COUNT(*)
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE()
+		AND table_name = ?
+		AND column_name = ?`
+}
+
+// ColumnsSQL implements Dialect
+func (mysqlDialect) ColumnsSQL() string {
+	return `
+		SELECT column_name, data_type, is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = DATABASE()
+		AND table_name = ?
+		ORDER BY ordinal_position`
+}
+
+// PrimaryKeySQL implements Dialect
+func (mysqlDialect) PrimaryKeySQL() string {
+	return `
+		SELECT column_name
+		FROM information_schema.key_column_usage
+		WHERE table_schema = DATABASE()
+		AND table_name = ?
+		AND constraint_name = 'PRIMARY'
+		ORDER BY ordinal_position`
+}
+
+// ForeignKeysSQL implements Dialect
+func (mysqlDialect) ForeignKeysSQL() string {
+	return `
+		SELECT k.constraint_name, k.table_name, k.column_name,
+			k.referenced_table_name, k.referenced_column_name, rc.delete_rule
+		FROM information_schema.key_column_usage k
+		JOIN information_schema.referential_constraints rc
+			ON rc.constraint_schema = k.constraint_schema
+			AND rc.constraint_name = k.constraint_name
+			AND rc.table_name = k.table_name
+		WHERE k.constraint_schema = DATABASE()
+		ORDER BY k.table_name, k.constraint_name, k.ordinal_position`
+}
+
+// DefinitionsSQL implements TableSwapper
+// MySQL copies the columns and indexes of tables with CREATE TABLE ... LIKE.
+func (mysqlDialect) DefinitionsSQL() string {
+	return ""
+}
+
+// ShadowTableSQL implements TableSwapper
+func (d mysqlDialect) ShadowTableSQL(table, shadow string, definitions []Definition) (string, error) {
+	return fmt.Sprintf("CREATE TABLE %s LIKE %s", d.Quote(shadow), d.Quote(table)), nil
+}
+
+// MirrorTriggersSQL implements TableSwapper
+func (d mysqlDialect) MirrorTriggersSQL(table, shadow string, columns, pk []string) []string {
+	replace := fmt.Sprintf("REPLACE INTO %s (%s) VALUES (%s)",
+		d.Quote(shadow), quoteColumns(d, "", columns), quoteColumns(d, "NEW.", columns))
+	remove := fmt.Sprintf("DELETE FROM %s WHERE %s", d.Quote(shadow), matchKey(d, pk))
+	return []string{
+		fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT ON %s FOR EACH ROW %s",
+			d.Quote(mirrorTrigger(shadow, "ins")), d.Quote(table), replace),
+		fmt.Sprintf("CREATE TRIGGER %s AFTER UPDATE ON %s FOR EACH ROW BEGIN %s; %s; END",
+			d.Quote(mirrorTrigger(shadow, "upd")), d.Quote(table), remove, replace),
+		fmt.Sprintf("CREATE TRIGGER %s AFTER DELETE ON %s FOR EACH ROW %s",
+			d.Quote(mirrorTrigger(shadow, "del")), d.Quote(table), remove),
+	}
+}
+
+// DropMirrorTriggersSQL implements TableSwapper
+func (d mysqlDialect) DropMirrorTriggersSQL(shadow string) []string {
+	var statements []string
+	for _, event := range []string{"ins", "upd", "del"} {
+		statements = append(statements, "DROP TRIGGER IF EXISTS "+d.Quote(mirrorTrigger(shadow, event)))
+	}
+	return statements
+}
+
+// InsertIgnoreSQL implements TableSwapper
+// The copied rows are read with shared locks, so that the triggers cannot change them
+// between the read and the insert.
+func (d mysqlDialect) InsertIgnoreSQL(table string, columns []string, query string) string {
+	return fmt.Sprintf("INSERT IGNORE INTO %s (%s) %s LOCK IN SHARE MODE", d.Quote(table), quoteColumns(d, "", columns), query)
+}
+
+// SwapSQL implements TableSwapper
+// RENAME TABLE swaps both tables atomically, but commits on its own like DROP TRIGGER:
+// the triggers are dropped before it, in statements of their own. Indexes are per table
+// in MySQL.
+func (d mysqlDialect) SwapSQL(table, shadow, old string, definitions []Definition) []string {
+	return []string{fmt.Sprintf("RENAME TABLE %s TO %s, %s TO %s", d.Quote(table), d.Quote(old), d.Quote(shadow), d.Quote(table))}
+}
@@ -0,0 +1,142 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// postgresDialect implements Dialect for PostgreSQL
+type postgresDialect struct{}
+
+// Name implements Dialect
+func (postgresDialect) Name() string {
+	return "postgres"
+}
+
+// DriverName implements Dialect
+func (postgresDialect) DriverName() string {
+	return "postgres"
+}
+
+// DefaultPort implements Dialect
+func (postgresDialect) DefaultPort() int {
+	return 5432
+}
+
+// DSN implements Dialect
+func (postgresDialect) DSN(config Config) string {
+	dsn := url.URL{
+		Scheme: "postgres",
+		Host:   config.Host + ":" + strconv.Itoa(config.Port),
+		Path:   "/" + config.Name,
+	}
+	if config.Password == "" {
+		dsn.User = url.User(config.User)
+	} else {
+		dsn.User = url.UserPassword(config.User, config.Password)
+	}
+
+	query := url.Values{}
+	sslMode := config.SSLMode
+	if sslMode == "" {
+		sslMode = "disable"
+	}
+	query.Set("sslmode", sslMode)
+	if config.Schema != "" {
+		query.Set("search_path", config.Schema)
+	}
+	dsn.RawQuery = query.Encode()
+
+	return dsn.String()
+}
+
+// Quote implements Dialect
+func (postgresDialect) Quote(name string) string {
+	return quoteWith(name, `"`)
+}
+
+// DeleteLimitSQL implements Dialect
+// PostgreSQL has no DELETE ... LIMIT, so the batch is selected by ctid
+func (d postgresDialect) DeleteLimitSQL(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE ctid = ANY(ARRAY(SELECT ctid FROM %s WHERE %s LIMIT %d))",
+		d.Quote(table), d.Quote(table), where, limit)
+}
+
+// RowListSQL implements Dialect
+func (postgresDialect) RowListSQL(rows []string) string {
+	return "(" + strings.Join(rows, ", ") + ")"
+}
+
+// GlobMatchSQL implements Dialect
+func (postgresDialect) GlobMatchSQL(column, pattern string) (string, interface{}) {
+	return likeMatch(column, pattern)
+}
+
+// TablesSQL implements Dialect
+func (postgresDialect) TablesSQL() string {
+	return `
+		SELECT table_name
+		FROM information_schema.tables
+		WHERE table_schema = current_schema()
+		AND table_type = 'BASE TABLE'`
+}
+
+// TableSizeSQL implements Dialect
+func (postgresDialect) TableSizeSQL() string {
+	return `
+		SELECT pg_total_relation_size(quote_ident(current_schema()) || '.' || quote_ident(?))`
+}
+
+// ColumnExistsSQL implements Dialect
+func (postgresDialect) ColumnExistsSQL() string {
+	return `
+		SELECT COUNT(*)
+		FROM information_schema.columns
+		WHERE table_schema = current_schema()
+		AND table_name = ?
+		AND column_name = ?`
+}
+
+// ColumnsSQL implements Dialect
+func (postgresDialect) ColumnsSQL() string {
+	return `
+		SELECT column_name, data_type, is_nullable
+		FROM information_schema.columns
+		WHERE table_schema = current_schema()
+		AND table_name = ?
+		ORDER BY ordinal_position`
+}
+
+// PrimaryKeySQL implements Dialect
+func (postgresDialect) PrimaryKeySQL() string {
+	return `
+		SELECT k.column_name
+		FROM information_schema.table_constraints c
+		JOIN information_schema.key_column_usage k
+			ON k.constraint_schema = c.constraint_schema
+			AND k.constraint_name = c.constraint_name
+			AND k.table_name = c.table_name
+		WHERE c.table_schema = current_schema()
+		AND c.table_name = ?
+		AND c.constraint_type = 'PRIMARY KEY'
+		ORDER BY k.ordinal_position`
+}
+
+// ForeignKeysSQL implements Dialect
+func (postgresDialect) ForeignKeysSQL() string {
+	return `
+		SELECT k.constraint_name, k.table_name, k.column_name,
+			u.table_name, u.column_name, rc.delete_rule
+		FROM information_schema.referential_constraints rc
+		JOIN information_schema.key_column_usage k
+			ON k.constraint_schema = rc.constraint_schema
+			AND k.constraint_name = rc.constraint_name
+		JOIN information_schema.key_column_usage u
+			ON u.constraint_schema = rc.unique_constraint_schema
+			AND u.constraint_name = rc.unique_constraint_name
+			AND u.ordinal_position = k.position_in_unique_constraint
+		WHERE rc.constraint_schema = current_schema()
+		ORDER BY k.table_name, k.constraint_name, k.ordinal_position`
+}
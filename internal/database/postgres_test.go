@@ -0,0 +1,158 @@
+package database
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+)
+
+// newPostgresMock wraps a mocked connection matching statements exactly, whitespace aside
+func newPostgresMock(t *testing.T) (*DB, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("failed to open mocked connection: %v", err)
+	}
+	db, err := NewWithDB(conn, "postgres")
+	if err != nil {
+		t.Fatalf("failed to wrap mocked connection: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return db, mock
+}
+
+func TestPostgresQuote(t *testing.T) {
+	d := postgresDialect{}
+	for name, expected := range map[string]string{
+		"dag_run":  `"dag_run"`,
+		"key":      `"key"`,
+		`odd"name`: `"odd""name"`,
+	} {
+		if quoted := d.Quote(name); quoted != expected {
+			t.Errorf("Quote(%q) = %s, expected %s", name, quoted, expected)
+		}
+	}
+}
+
+// Batches are deleted by ctid, with the placeholders of the condition rebound to $n
+func TestPostgresDeleteLimit(t *testing.T) {
+	db, mock := newPostgresMock(t)
+	where := `"dag_id" = ? AND "execution_date" < ?`
+	mock.ExpectExec(`DELETE FROM "dag_run" WHERE ctid = ANY(ARRAY(SELECT ctid FROM "dag_run" WHERE "dag_id" = $1 AND "execution_date" < $2 LIMIT 500))`).
+		WithArgs("etl", "2024-01-01").
+		WillReturnResult(sqlmock.NewResult(0, 500))
+
+	result, err := db.Exec(db.Dialect().DeleteLimitSQL("dag_run", where, 500), "etl", "2024-01-01")
+	if err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if n, _ := result.RowsAffected(); n != 500 {
+		t.Errorf("deleted %d rows, expected 500", n)
+	}
+}
+
+func TestPostgresRowList(t *testing.T) {
+	db, mock := newPostgresMock(t)
+	condition := `("dag_id", "run_id") IN ` + db.RowList([]string{"(?, ?)", "(?, ?)"})
+	mock.ExpectExec(`DELETE FROM "dag_run" WHERE ("dag_id", "run_id") IN (($1, $2), ($3, $4))`).
+		WithArgs("a", "r1", "b", "r2").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if _, err := db.Exec(`DELETE FROM "dag_run" WHERE `+condition, "a", "r1", "b", "r2"); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+}
+
+func TestPostgresSchemaQueries(t *testing.T) {
+	db, mock := newPostgresMock(t)
+	d := postgresDialect{}
+
+	mock.ExpectQuery(d.TablesSQL()).
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("dag_run").AddRow("task_instance"))
+	tables, err := db.Tables()
+	if err != nil {
+		t.Fatalf("failed to list tables: %v", err)
+	}
+	if !reflect.DeepEqual(tables, []string{"dag_run", "task_instance"}) {
+		t.Errorf("tables %v, expected dag_run and task_instance", tables)
+	}
+
+	mock.ExpectQuery(`SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2`).
+		WithArgs("dag_run", "run_after").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(0))
+	exists, err := db.ColumnExists("dag_run", "run_after")
+	if err != nil {
+		t.Fatalf("failed to check column: %v", err)
+	}
+	if exists {
+		t.Errorf("column run_after exists, expected it not to")
+	}
+
+	mock.ExpectQuery(`SELECT column_name, data_type, is_nullable FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 ORDER BY ordinal_position`).
+		WithArgs("log").
+		WillReturnRows(sqlmock.NewRows([]string{"column_name", "data_type", "is_nullable"}).
+			AddRow("id", "integer", "NO").
+			AddRow("dttm", "timestamp with time zone", "YES"))
+	columns, err := db.Columns("log")
+	if err != nil {
+		t.Fatalf("failed to list columns: %v", err)
+	}
+	expectedColumns := []Column{{"id", "integer", false}, {"dttm", "timestamp with time zone", true}}
+	if !reflect.DeepEqual(columns, expectedColumns) {
+		t.Errorf("columns %+v, expected %+v", columns, expectedColumns)
+	}
+
+	mock.ExpectQuery(sqlx.Rebind(sqlx.DOLLAR, d.PrimaryKeySQL())).
+		WithArgs("task_instance").
+		WillReturnRows(sqlmock.NewRows([]string{"column_name"}).
+			AddRow("dag_id").AddRow("task_id").AddRow("run_id").AddRow("map_index"))
+	pk, err := db.PrimaryKey("task_instance")
+	if err != nil {
+		t.Fatalf("failed to read primary key: %v", err)
+	}
+	if !reflect.DeepEqual(pk, []string{"dag_id", "task_id", "run_id", "map_index"}) {
+		t.Errorf("primary key %v, expected dag_id, task_id, run_id, map_index", pk)
+	}
+
+	mock.ExpectQuery(`SELECT pg_total_relation_size(quote_ident(current_schema()) || '.' || quote_ident($1))`).
+		WithArgs("xcom").
+		WillReturnRows(sqlmock.NewRows([]string{"size"}).AddRow(8192))
+	size, err := db.TableSize("xcom")
+	if err != nil {
+		t.Fatalf("failed to read table size: %v", err)
+	}
+	if size != 8192 {
+		t.Errorf("table size %d, expected 8192", size)
+	}
+}
+
+// Columns of a composite foreign key come on consecutive rows and are grouped by constraint
+func TestPostgresForeignKeys(t *testing.T) {
+	db, mock := newPostgresMock(t)
+	mock.ExpectQuery(postgresDialect{}.ForeignKeysSQL()).
+		WillReturnRows(sqlmock.NewRows([]string{"constraint_name", "table_name", "column_name", "table_name", "column_name", "delete_rule"}).
+			AddRow("task_instance_dag_run_fkey", "task_instance", "dag_id", "dag_run", "dag_id", "CASCADE").
+			AddRow("task_instance_dag_run_fkey", "task_instance", "run_id", "dag_run", "run_id", "CASCADE").
+			AddRow("xcom_task_instance_fkey", "xcom", "dag_id", "task_instance", "dag_id", "cascade"))
+
+	foreignKeys, err := db.ForeignKeys()
+	if err != nil {
+		t.Fatalf("failed to list foreign keys: %v", err)
+	}
+	expected := []ForeignKey{
+		{Name: "task_instance_dag_run_fkey", Table: "task_instance", Columns: []string{"dag_id", "run_id"},
+			ReferencedTable: "dag_run", ReferencedColumns: []string{"dag_id", "run_id"}, DeleteRule: "CASCADE"},
+		{Name: "xcom_task_instance_fkey", Table: "xcom", Columns: []string{"dag_id"},
+			ReferencedTable: "task_instance", ReferencedColumns: []string{"dag_id"}, DeleteRule: "CASCADE"},
+	}
+	if !reflect.DeepEqual(foreignKeys, expected) {
+		t.Errorf("foreign keys %+v, expected %+v", foreignKeys, expected)
+	}
+}
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// sqliteTimeFormat is the format SQLAlchemy uses to store datetimes in SQLite
+const sqliteTimeFormat = "2006-01-02 15:04:05.000000"
+
+// sqliteDialect implements Dialect for SQLite
+// The modernc.org/sqlite driver is written in Go, so that cross-compiled binaries built
+// without cgo support SQLite too.
+type sqliteDialect struct{}
+
+// Name implements Dialect
+func (sqliteDialect) Name() string {
+	return "sqlite"
+}
+
+// DriverName implements Dialect
+func (sqliteDialect) DriverName() string {
+	return "sqlite"
+}
+
+// DefaultPort implements Dialect
+func (sqliteDialect) DefaultPort() int {
+	return 0
+}
+
+// DSN implements Dialect
+// A leading ~ of the path is expanded to the home directory, as in ~/airflow/airflow.db.
+func (sqliteDialect) DSN(config Config) string {
+	query := url.Values{}
+	query.Add("_pragma", "busy_timeout(5000)")
+	query.Add("_pragma", "foreign_keys(1)")
+	return "file:" + expandHome(config.Path) + "?" + query.Encode()
+}
+
+// expandHome replaces the leading ~ of a path with the home directory of the user
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+// Quote implements Dialect
+func (sqliteDialect) Quote(name string) string {
+	return quoteWith(name, `"`)
+}
+
+// DeleteLimitSQL implements Dialect
+// SQLite is usually built without DELETE ... LIMIT, so the batch is selected by rowid
+func (d sqliteDialect) DeleteLimitSQL(table, where string, limit int) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE rowid IN (SELECT rowid FROM %s WHERE %s LIMIT %d)",
+		d.Quote(table), d.Quote(table), where, limit)
+}
+
+// RowListSQL implements Dialect
+// SQLite only accepts a subquery on the right-hand side of a row value IN
+func (sqliteDialect) RowListSQL(rows []string) string {
+	return "(VALUES " + strings.Join(rows, ", ") + ")"
+}
+
+// GlobMatchSQL implements Dialect
+// LIKE is case-insensitive in SQLite, GLOB is case-sensitive and uses * and ? already;
+// the [ of character classes is matched literally as [[].
+func (sqliteDialect) GlobMatchSQL(column, pattern string) (string, interface{}) {
+	return column + " GLOB ?", strings.ReplaceAll(pattern, "[", "[[]")
+}
+
+// TablesSQL implements Dialect
+func (sqliteDialect) TablesSQL() string {
+	return `
+		SELECT name
+		FROM sqlite_master
+		WHERE type = 'table'
+		AND name NOT LIKE 'sqlite_%'`
+}
+
+// TableSizeSQL implements Dialect
+func (sqliteDialect) TableSizeSQL() string {
+	// Table sizes are only available through the optional dbstat virtual table
+	return ""
+}
+
+// ColumnExistsSQL implements Dialect
+func (sqliteDialect) ColumnExistsSQL() string {
+	return `
+		SELECT COUNT(*)
+		FROM pragma_table_info(?)
+		WHERE name = ?`
+}
+
+// ColumnsSQL implements Dialect
+// Types are the declared ones, e.g. VARCHAR(250); primary key columns are never null.
+func (sqliteDialect) ColumnsSQL() string {
+	return `
+		SELECT name, type, CASE WHEN "notnull" = 0 AND pk = 0 THEN 'YES' ELSE 'NO' END
+		FROM pragma_table_info(?)
+		ORDER BY cid`
+}
+
+// PrimaryKeySQL implements Dialect
+// The pk field of a column is its position in the primary key, 0 for other columns.
+func (sqliteDialect) PrimaryKeySQL() string {
+	return `
+		SELECT name
+		FROM pragma_table_info(?)
+		WHERE pk > 0
+		ORDER BY pk`
+}
+
+// ForeignKeysSQL implements Dialect
+// Foreign keys are unnamed, they are identified by their id within the table. A foreign key
+// without referenced columns references the primary key of the referenced table.
+func (sqliteDialect) ForeignKeysSQL() string {
+	return `
+		SELECT m.name || '_fk' || f.id, m.name, f."from", f."table",
+			COALESCE(f."to", (SELECT p.name FROM pragma_table_info(f."table") p WHERE p.pk = f.seq + 1)),
+			f.on_delete
+		FROM sqlite_master m
+		JOIN pragma_foreign_key_list(m.name) f
+		WHERE m.type = 'table'
+		ORDER BY m.name, f.id, f.seq`
+}
+
+// ConvertArg implements argConverter
+// Airflow stores UTC datetimes as text, so times are compared in the same text format
+func (sqliteDialect) ConvertArg(arg interface{}) interface{} {
+	if t, ok := arg.(time.Time); ok {
+		return t.UTC().Format(sqliteTimeFormat)
+	}
+	return arg
+}
+
+// sqliteCreateTable matches the CREATE TABLE statement of a table up to its columns
+var sqliteCreateTable = regexp.MustCompile("(?is)^\\s*CREATE\\s+TABLE\\s+(?:\"(?:[^\"]|\"\")*\"|`[^`]*`|\\[[^\\]]*\\]|[^\\s(]+)\\s*\\(")
+
+// DefinitionsSQL implements TableSwapper
+// Automatic indexes of primary keys and unique constraints have no statement.
+func (sqliteDialect) DefinitionsSQL() string {
+	return `
+		SELECT type, name, sql
+		FROM sqlite_master
+		WHERE tbl_name = ?
+		AND type IN ('table', 'index')
+		AND sql IS NOT NULL
+		ORDER BY type = 'index', name`
+}
+
+// ShadowTableSQL implements TableSwapper
+// The shadow table is created from the statement of the table, with its keys but without
+// its indexes, whose names are global; they are created again when the tables are swapped.
+func (d sqliteDialect) ShadowTableSQL(table, shadow string, definitions []Definition) (string, error) {
+	for _, definition := range definitions {
+		if definition.Type == "table" && sqliteCreateTable.MatchString(definition.SQL) {
+			return sqliteCreateTable.ReplaceAllLiteralString(definition.SQL, "CREATE TABLE "+d.Quote(shadow)+" ("), nil
+		}
+	}
+	return "", fmt.Errorf("no CREATE TABLE statement found for table %s", table)
+}
+
+// MirrorTriggersSQL implements TableSwapper
+func (d sqliteDialect) MirrorTriggersSQL(table, shadow string, columns, pk []string) []string {
+	replace := fmt.Sprintf("INSERT OR REPLACE INTO %s (%s) VALUES (%s);",
+		d.Quote(shadow), quoteColumns(d, "", columns), quoteColumns(d, "NEW.", columns))
+	remove := fmt.Sprintf("DELETE FROM %s WHERE %s;", d.Quote(shadow), matchKey(d, pk))
+	return []string{
+		fmt.Sprintf("CREATE TRIGGER %s AFTER INSERT ON %s BEGIN %s END",
+			d.Quote(mirrorTrigger(shadow, "ins")), d.Quote(table), replace),
+		fmt.Sprintf("CREATE TRIGGER %s AFTER UPDATE ON %s BEGIN %s %s END",
+			d.Quote(mirrorTrigger(shadow, "upd")), d.Quote(table), remove, replace),
+		fmt.Sprintf("CREATE TRIGGER %s AFTER DELETE ON %s BEGIN %s END",
+			d.Quote(mirrorTrigger(shadow, "del")), d.Quote(table), remove),
+	}
+}
+
+// DropMirrorTriggersSQL implements TableSwapper
+func (d sqliteDialect) DropMirrorTriggersSQL(shadow string) []string {
+	var statements []string
+	for _, event := range []string{"ins", "upd", "del"} {
+		statements = append(statements, "DROP TRIGGER IF EXISTS "+d.Quote(mirrorTrigger(shadow, event)))
+	}
+	return statements
+}
+
+// InsertIgnoreSQL implements TableSwapper
+func (d sqliteDialect) InsertIgnoreSQL(table string, columns []string, query string) string {
+	return fmt.Sprintf("INSERT OR IGNORE INTO %s (%s) %s", d.Quote(table), quoteColumns(d, "", columns), query)
+}
+
+// SwapSQL implements TableSwapper
+// The indexes stay with the renamed table, so they are dropped from it and created again
+// from their statements, which name the swapped table.
+func (d sqliteDialect) SwapSQL(table, shadow, old string, definitions []Definition) []string {
+	statements := []string{
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", d.Quote(table), d.Quote(old)),
+		fmt.Sprintf("ALTER TABLE %s RENAME TO %s", d.Quote(shadow), d.Quote(table)),
+	}
+	for _, definition := range definitions {
+		if definition.Type == "index" {
+			statements = append(statements, "DROP INDEX "+d.Quote(definition.Name), definition.SQL)
+		}
+	}
+	return statements
+}
@@ -0,0 +1,39 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// The home directory of a ~ path is expanded, other paths are kept as they are
+func TestSQLiteDSN(t *testing.T) {
+	t.Setenv("HOME", "/home/airflow")
+	const pragmas = "?_pragma=busy_timeout%285000%29&_pragma=foreign_keys%281%29"
+	for path, expected := range map[string]string{
+		"~/airflow/airflow.db":      "file:" + filepath.Join("/home/airflow", "airflow", "airflow.db") + pragmas,
+		"/var/lib/airflow.db":       "file:/var/lib/airflow.db" + pragmas,
+		"airflow~/airflow.db":       "file:airflow~/airflow.db" + pragmas,
+		"~other/airflow/airflow.db": "file:~other/airflow/airflow.db" + pragmas,
+	} {
+		if dsn := (sqliteDialect{}).DSN(Config{Path: path}); dsn != expected {
+			t.Errorf("DSN of %s = %s, expected %s", path, dsn, expected)
+		}
+	}
+}
+
+// Foreign keys are enforced on the connections of the pure Go driver
+func TestSQLiteForeignKeys(t *testing.T) {
+	db, err := New(Config{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "airflow.db")})
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var enabled int
+	if err := db.Get(&enabled, "PRAGMA foreign_keys"); err != nil {
+		t.Fatalf("failed to read foreign_keys pragma: %v", err)
+	}
+	if enabled != 1 {
+		t.Errorf("foreign keys are not enforced")
+	}
+}
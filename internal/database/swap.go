@@ -0,0 +1,80 @@
+package database
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TableSwapper is implemented by the dialects whose tables can be replaced by a shadow
+// copy: the shadow table is created with the keys of the table, kept up to date by triggers
+// while rows are copied to it, then renamed to the name of the table
+type TableSwapper interface {
+	// DefinitionsSQL returns a query listing the type (table or index), name and CREATE
+	// statement of a table and its indexes, taking the table name as argument, or an empty
+	// string when the dialect copies tables by itself
+	DefinitionsSQL() string
+	// ShadowTableSQL builds the statement creating shadow with the columns and keys of table,
+	// given the definitions of table
+	ShadowTableSQL(table, shadow string, definitions []Definition) (string, error)
+	// MirrorTriggersSQL builds the statements creating the triggers that apply the inserts,
+	// updates and deletes of table to shadow
+	MirrorTriggersSQL(table, shadow string, columns, pk []string) []string
+	// DropMirrorTriggersSQL builds the statements dropping the triggers of MirrorTriggersSQL
+	DropMirrorTriggersSQL(shadow string) []string
+	// InsertIgnoreSQL builds a statement inserting the rows selected by query into the
+	// columns of table, skipping the rows whose primary key already exists
+	InsertIgnoreSQL(table string, columns []string, query string) string
+	// SwapSQL builds the statements renaming table to old and shadow to table, and restoring
+	// the indexes of table given its definitions, run once the triggers are dropped. They run
+	// in a transaction, which does not make them atomic where DDL statements commit on their own.
+	SwapSQL(table, shadow, old string, definitions []Definition) []string
+}
+
+// Definition is the CREATE statement of a table or of one of its indexes
+type Definition struct {
+	Type string `db:"type"` // table or index
+	Name string `db:"name"`
+	SQL  string `db:"sql"`
+}
+
+// Swapper returns the table swapper of the database dialect, false when tables cannot be swapped
+func (db *DB) Swapper() (TableSwapper, bool) {
+	swapper, ok := db.dialect.(TableSwapper)
+	return swapper, ok
+}
+
+// Definitions lists the definitions a swapper needs to copy a table, empty when it needs none
+func (db *DB) Definitions(swapper TableSwapper, table string) ([]Definition, error) {
+	var definitions []Definition
+	query := swapper.DefinitionsSQL()
+	if query == "" || db.mock {
+		return definitions, nil
+	}
+	if err := db.Select(&definitions, query, table); err != nil {
+		return nil, fmt.Errorf("failed to read definition of table %s: %w", table, err)
+	}
+	return definitions, nil
+}
+
+// mirrorTrigger names the trigger applying an event of a table to its shadow table
+func mirrorTrigger(shadow, event string) string {
+	return shadow + "_" + event
+}
+
+// quoteColumns quotes the columns of a row, prefixed with NEW. or OLD. in triggers
+func quoteColumns(d Dialect, prefix string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = prefix + d.Quote(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// matchKey builds the condition matching the shadow row of the OLD row of a trigger
+func matchKey(d Dialect, pk []string) string {
+	conditions := make([]string, len(pk))
+	for i, column := range pk {
+		conditions[i] = fmt.Sprintf("%s = OLD.%s", d.Quote(column), d.Quote(column))
+	}
+	return strings.Join(conditions, " AND ")
+}
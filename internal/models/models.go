@@ -2,59 +2,63 @@ package models
 
 import "time"
 
+// The structs below describe the columns of the Airflow 2 tables the cleaning relies on.
+// Nullable columns are pointers, or nil slices for binary columns; schema-check compares
+// them with the live schema.
+
 // DagRun represents a DAG run
 type DagRun struct {
-	ID                     int64     `db:"id"`
-	DagID                  string    `db:"dag_id"`
-	ExecutionDate          time.Time `db:"execution_date"`
-	State                  string    `db:"state"`
-	RunID                  string    `db:"run_id"`
-	ExternalTrigger        bool      `db:"external_trigger"`
-	Conf                   []byte    `db:"conf"`
-	StartDate              time.Time `db:"start_date"`
-	EndDate                time.Time `db:"end_date"`
-	DataIntervalStart      time.Time `db:"data_interval_start"`
-	DataIntervalEnd        time.Time `db:"data_interval_end"`
-	LastSchedulingDecision time.Time `db:"last_scheduling_decision"`
-	RunType                string    `db:"run_type"`
-	CreatingJobID          int64     `db:"creating_job_id"`
-	DagHash                string    `db:"dag_hash"`
-	UpdatedAt              time.Time `db:"updated_at"`
-	QueuedAt               time.Time `db:"queued_at"`
-	LogTemplateID          int64     `db:"log_template_id"`
+	ID                     int64      `db:"id"`
+	DagID                  string     `db:"dag_id"`
+	ExecutionDate          time.Time  `db:"execution_date"`
+	State                  *string    `db:"state"`
+	RunID                  string     `db:"run_id"`
+	ExternalTrigger        *bool      `db:"external_trigger"`
+	Conf                   []byte     `db:"conf"`
+	StartDate              *time.Time `db:"start_date"`
+	EndDate                *time.Time `db:"end_date"`
+	DataIntervalStart      *time.Time `db:"data_interval_start"`
+	DataIntervalEnd        *time.Time `db:"data_interval_end"`
+	LastSchedulingDecision *time.Time `db:"last_scheduling_decision"`
+	RunType                string     `db:"run_type"`
+	CreatingJobID          *int64     `db:"creating_job_id"`
+	DagHash                *string    `db:"dag_hash"`
+	UpdatedAt              *time.Time `db:"updated_at"`
+	QueuedAt               *time.Time `db:"queued_at"`
+	LogTemplateID          *int64     `db:"log_template_id"`
 }
 
 // TaskInstance represents a task instance
 type TaskInstance struct {
-	TaskID             string    `db:"task_id"`
-	DagID              string    `db:"dag_id"`
-	RunID              string    `db:"run_id"`
-	MapIndex           int       `db:"map_index"`
-	StartDate          time.Time `db:"start_date"`
-	EndDate            time.Time `db:"end_date"`
-	Duration           float64   `db:"duration"`
-	State              string    `db:"state"`
-	TryNumber          int       `db:"try_number"`
-	MaxTries           int       `db:"max_tries"`
-	Hostname           string    `db:"hostname"`
-	Unixname           string    `db:"unixname"`
-	JobID              int64     `db:"job_id"`
-	Pool               string    `db:"pool"`
-	PoolSlots          int       `db:"pool_slots"`
-	Queue              string    `db:"queue"`
-	PriorityWeight     int       `db:"priority_weight"`
-	Operator           string    `db:"operator"`
-	QueuedDttm         time.Time `db:"queued_dttm"`
-	PID                int       `db:"pid"`
-	ExecutorConfig     []byte    `db:"executor_config"`
-	ExternalExecutorID string    `db:"external_executor_id"`
-	TriggerID          int64     `db:"trigger_id"`
-	TriggerTimeout     time.Time `db:"trigger_timeout"`
-	NextMethod         string    `db:"next_method"`
-	NextKwargs         []byte    `db:"next_kwargs"`
-	QueuedByJobID      int64     `db:"queued_by_job_id"`
-	CustomOperatorName string    `db:"custom_operator_name"`
-	UpdatedAt          time.Time `db:"updated_at"`
+	TaskID             string     `db:"task_id"`
+	DagID              string     `db:"dag_id"`
+	RunID              string     `db:"run_id"`
+	MapIndex           int        `db:"map_index"`
+	StartDate          *time.Time `db:"start_date"`
+	EndDate            *time.Time `db:"end_date"`
+	Duration           *float64   `db:"duration"`
+	State              *string    `db:"state"`
+	TryNumber          *int       `db:"try_number"`
+	MaxTries           *int       `db:"max_tries"`
+	Hostname           *string    `db:"hostname"`
+	Unixname           *string    `db:"unixname"`
+	JobID              *int64     `db:"job_id"`
+	Pool               string     `db:"pool"`
+	PoolSlots          int        `db:"pool_slots"`
+	Queue              *string    `db:"queue"`
+	PriorityWeight     *int       `db:"priority_weight"`
+	Operator           *string    `db:"operator"`
+	QueuedDttm         *time.Time `db:"queued_dttm"`
+	PID                *int       `db:"pid"`
+	ExecutorConfig     []byte     `db:"executor_config"`
+	ExternalExecutorID *string    `db:"external_executor_id"`
+	TriggerID          *int64     `db:"trigger_id"`
+	TriggerTimeout     *time.Time `db:"trigger_timeout"`
+	NextMethod         *string    `db:"next_method"`
+	NextKwargs         []byte     `db:"next_kwargs"`
+	QueuedByJobID      *int64     `db:"queued_by_job_id"`
+	CustomOperatorName *string    `db:"custom_operator_name"`
+	UpdatedAt          *time.Time `db:"updated_at"`
 }
 
 // XCom represents the data for communication between tasks
@@ -71,29 +75,29 @@ type XCom struct {
 
 // Log represents a log record
 type Log struct {
-	ID            int64     `db:"id"`
-	DagID         string    `db:"dag_id"`
-	TaskID        string    `db:"task_id"`
-	ExecutionDate time.Time `db:"execution_date"`
-	Dttm          time.Time `db:"dttm"`
-	Event         string    `db:"event"`
-	Owner         string    `db:"owner"`
-	Extra         string    `db:"extra"`
-	MapIndex      int       `db:"map_index"`
+	ID            int64      `db:"id"`
+	DagID         *string    `db:"dag_id"`
+	TaskID        *string    `db:"task_id"`
+	ExecutionDate *time.Time `db:"execution_date"`
+	Dttm          *time.Time `db:"dttm"`
+	Event         *string    `db:"event"`
+	Owner         *string    `db:"owner"`
+	Extra         *string    `db:"extra"`
+	MapIndex      *int       `db:"map_index"`
 }
 
 // Job represents an Airflow job record
 type Job struct {
-	ID              int64     `db:"id"`
-	DagID           string    `db:"dag_id"`
-	State           string    `db:"state"`
-	JobType         string    `db:"job_type"`
-	StartDate       time.Time `db:"start_date"`
-	EndDate         time.Time `db:"end_date"`
-	LatestHeartbeat time.Time `db:"latest_heartbeat"`
-	Hostname        string    `db:"hostname"`
-	Unixname        string    `db:"unixname"`
-	ExecutorClass   string    `db:"executor_class"`
+	ID              int64      `db:"id"`
+	DagID           *string    `db:"dag_id"`
+	State           *string    `db:"state"`
+	JobType         *string    `db:"job_type"`
+	StartDate       *time.Time `db:"start_date"`
+	EndDate         *time.Time `db:"end_date"`
+	LatestHeartbeat *time.Time `db:"latest_heartbeat"`
+	Hostname        *string    `db:"hostname"`
+	Unixname        *string    `db:"unixname"`
+	ExecutorClass   *string    `db:"executor_class"`
 }
 
 // TableConfig stores the configuration information of a table
@@ -101,18 +105,102 @@ type TableConfig struct {
 	TableName     string
 	RetentionDays int
 	DateColumn    string
-	PrimaryKey    string // Primary key column name
+	// Date columns used in order for the records whose DateColumn is NULL, e.g. tasks that never started
+	FallbackDateColumns []string
+	PrimaryKey          string // Expected primary key columns, discovered from the database and only checked when set
+	Enabled             bool   // Disabled tables are skipped
+	// Retention of the records of the DAGs matching a dag_id pattern, first match wins
+	DagOverrides []DagOverride
+	// Retention days per value of the state column, other states use RetentionDays
+	StateRetention map[string]int
+	// States of records never cleaned, such as running or queued
+	ExcludedStates []string
+	// Cleaning strategy, StrategyDefault to delete expired records by the date column
+	Strategy string
+	// Length of the date windows of StrategyDateWindow, one day when 0
+	DateWindow time.Duration
+	// Table holding the date column when the table has none, nil for the table itself
+	DateJoin *DateJoin
+	// Additional SQL condition expired records must match to be cleaned, empty for none
+	Condition string
+}
+
+// DateJoin takes the date of the records of a table from the matching record of another table
+type DateJoin struct {
+	Table             string   // Table holding the date column
+	Columns           []string // Columns of the table matching the records of the joined table
+	ReferencedColumns []string // Matching columns of the joined table, the same names as Columns when empty
+}
+
+// Cleaning strategies
+const (
+	StrategyDefault    = ""            // Delete the expired records of the table by its date column
+	StrategyRunCascade = "run_cascade" // Delete expired DAG runs with all the records of their dependent tables
+	StrategyPKRange    = "pk_range"    // Delete expired records by windows of an integer primary key
+	StrategyDateWindow = "date_window" // Delete expired records by windows of the date column, oldest first
+	StrategyCopySwap   = "copy_swap"   // Copy the records to keep to a new table and swap it with the table
+)
+
+// DagOverride overrides the retention of a table for the DAGs matching a pattern
+type DagOverride struct {
+	DagPattern    string // dag_id glob pattern, * matches any characters and ? a single character
+	RetentionDays int
+}
+
+// Archive modes
+const (
+	ArchiveModeFile  = "file"  // Write deleted records to compressed files
+	ArchiveModeTable = "table" // Copy deleted records to _airflow_deleted__<table>__<timestamp> tables
+)
+
+// Archive file formats
+const (
+	ArchiveFormatJSONL = "jsonl"
+	ArchiveFormatCSV   = "csv"
+)
+
+// ArchiveConfig stores the configuration for archiving records before deletion
+type ArchiveConfig struct {
+	Mode      string // Empty to disable archiving
+	Directory string // Directory of archive files
+	Format    string // Archive file format, jsonl or csv
+}
+
+// Forms of the conditions matching composite primary keys
+const (
+	KeyFormRowIn = "row_in" // (a, b) IN ((?, ?), ...)
+	KeyFormOr    = "or"     // (a = ? AND b = ?) OR ..., for servers not optimizing row constructors
+)
+
+// Zombie job actions
+const (
+	ZombieActionFail   = "fail"   // Mark zombie jobs failed, ending them at their latest heartbeat
+	ZombieActionDelete = "delete" // Delete zombie jobs regardless of the job retention
+)
+
+// ZombieJobPolicy stores how running jobs that stopped heartbeating are handled
+type ZombieJobPolicy struct {
+	HeartbeatTimeout time.Duration // Running jobs whose latest heartbeat is older are dead, 0 to disable
+	Action           string        // ZombieActionFail or ZombieActionDelete
 }
 
 // Config stores all cleaning configurations
 type Config struct {
-	RetentionDays map[string]int
-	BatchSize     int
-	DryRun        bool
-	Verbose       bool
-	SleepSeconds  float64
+	Tables       []TableConfig // Tables to clean, in cleaning order
+	BatchSize    int
+	DryRun       bool
+	Verbose      bool
+	SleepSeconds float64
 	// Determines which deletion method to use
 	// When true, uses primary key-based deletion (slower first query, faster deletes)
 	// When false, uses direct DELETE...LIMIT method (simpler but may be slower for large tables)
 	UsePrimaryKeyDelete bool
+	// Form of the conditions matching composite primary keys, and number of keys per condition
+	CompositeKeyForm string
+	KeyChunkSize     int
+	Archive          ArchiveConfig
+	// Number of most recent runs of each DAG kept regardless of age, with the
+	// records of tables referencing them, 0 to disable
+	KeepLastRunsPerDag int
+	ZombieJobs         ZombieJobPolicy
 }
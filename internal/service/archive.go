@@ -0,0 +1,228 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// csvNull represents NULL values in CSV archives
+const csvNull = `\N`
+
+// fileArchive writes deleted records of one table to a gzip-compressed archive file
+type fileArchive struct {
+	path    string
+	format  string
+	file    *os.File
+	gz      *gzip.Writer
+	buf     *bufio.Writer
+	csv     *csv.Writer
+	columns []string
+	rows    int
+}
+
+// archiveFileName returns the archive file name of a table for a run, timestamped in UTC
+// like archive tables
+func archiveFileName(table string, startAt time.Time, format string) string {
+	return fmt.Sprintf("%s__%s.%s.gz", table, startAt.UTC().Format(archiveTimestampFormat), format)
+}
+
+// openFileArchive creates the archive file of a table for the current run
+func (c *Cleaner) openFileArchive(table string) (*fileArchive, error) {
+	format := c.config.Archive.Format
+	if format == "" {
+		format = models.ArchiveFormatJSONL
+	}
+	if format != models.ArchiveFormatJSONL && format != models.ArchiveFormatCSV {
+		return nil, fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	if err := os.MkdirAll(c.config.Archive.Directory, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	path := filepath.Join(c.config.Archive.Directory, archiveFileName(table, c.startAt, format))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	archive := &fileArchive{
+		path:   path,
+		format: format,
+		file:   file,
+		gz:     gzip.NewWriter(file),
+	}
+	archive.buf = bufio.NewWriter(archive.gz)
+	if format == models.ArchiveFormatCSV {
+		archive.csv = csv.NewWriter(archive.buf)
+	}
+
+	log.Printf("Archiving records of table %s to %s", table, path)
+	return archive, nil
+}
+
+// tableArchive returns the archive file of a table for the current run, opening it on first use
+func (c *Cleaner) tableArchive(table string) (*fileArchive, error) {
+	if archive, ok := c.archives[table]; ok {
+		return archive, nil
+	}
+	archive, err := c.openFileArchive(table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	if c.archives == nil {
+		c.archives = make(map[string]*fileArchive)
+	}
+	c.archives[table] = archive
+	return archive, nil
+}
+
+// closeArchives closes the archive files opened during the run
+func (c *Cleaner) closeArchives() error {
+	var firstErr error
+	for table, archive := range c.archives {
+		if err := archive.Close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close archive of table %s: %w", table, err)
+		}
+	}
+	c.archives = nil
+	return firstErr
+}
+
+// WriteBatch writes a batch of records and syncs the file to disk,
+// so the batch can be safely deleted once it returns
+func (a *fileArchive) WriteBatch(columns []string, types []*sql.ColumnType, rows [][]interface{}) error {
+	binary := binaryColumns(types)
+
+	if a.columns == nil {
+		a.columns = columns
+		if a.csv != nil {
+			if err := a.csv.Write(columns); err != nil {
+				return err
+			}
+		}
+	} else if strings.Join(a.columns, ",") != strings.Join(columns, ",") {
+		return fmt.Errorf("columns of table changed while archiving")
+	}
+
+	for _, row := range rows {
+		if a.csv != nil {
+			record := make([]string, len(row))
+			for i, value := range row {
+				record[i] = encodeCSVValue(value, binary[i])
+			}
+			if err := a.csv.Write(record); err != nil {
+				return err
+			}
+			continue
+		}
+
+		record := make(map[string]interface{}, len(row))
+		for i, value := range row {
+			record[columns[i]] = encodeArchiveValue(value, binary[i])
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if _, err := a.buf.Write(append(line, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if err := a.flush(); err != nil {
+		return err
+	}
+	a.rows += len(rows)
+	return nil
+}
+
+// flush flushes all buffered data and fsyncs the archive file
+func (a *fileArchive) flush() error {
+	if a.csv != nil {
+		a.csv.Flush()
+		if err := a.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if err := a.buf.Flush(); err != nil {
+		return err
+	}
+	if err := a.gz.Flush(); err != nil {
+		return err
+	}
+	return a.file.Sync()
+}
+
+// Close finishes the gzip stream and closes the archive file
+func (a *fileArchive) Close() error {
+	if err := a.flush(); err != nil {
+		a.file.Close()
+		return err
+	}
+	if err := a.gz.Close(); err != nil {
+		a.file.Close()
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	if err := a.file.Close(); err != nil {
+		return err
+	}
+
+	log.Printf("Archived %d records to %s", a.rows, a.path)
+	return nil
+}
+
+// binaryColumns reports which columns hold binary data
+func binaryColumns(types []*sql.ColumnType) []bool {
+	binary := make([]bool, len(types))
+	for i, t := range types {
+		binary[i] = isBinaryType(t.DatabaseTypeName())
+	}
+	return binary
+}
+
+// isBinaryType reports whether a database type name is a binary type
+func isBinaryType(typeName string) bool {
+	typeName = strings.ToUpper(typeName)
+	return strings.Contains(typeName, "BLOB") || strings.Contains(typeName, "BINARY") || typeName == "BYTEA"
+}
+
+// encodeArchiveValue converts a database value to its archived representation:
+// binary data is base64-encoded and times are RFC 3339 strings
+func encodeArchiveValue(value interface{}, binary bool) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		if binary {
+			return base64.StdEncoding.EncodeToString(v)
+		}
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
+
+// encodeCSVValue converts a database value to a CSV field
+func encodeCSVValue(value interface{}, binary bool) string {
+	if value == nil {
+		return csvNull
+	}
+	return fmt.Sprint(encodeArchiveValue(value, binary))
+}
@@ -0,0 +1,131 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArchiveTablePrefix is the prefix of archive tables, the same one `airflow db clean` uses
+const ArchiveTablePrefix = "_airflow_deleted__"
+
+// archiveTimestampFormat is the format of the timestamp suffix of archive table names
+const archiveTimestampFormat = "20060102150405"
+
+// maxIdentifierLength is the shortest identifier length limit of the supported databases (PostgreSQL)
+const maxIdentifierLength = 63
+
+// archiveTablePattern matches archive table names and captures the table and timestamp
+var archiveTablePattern = regexp.MustCompile(`^` + ArchiveTablePrefix + `(.+)__(\d{14})$`)
+
+// ArchiveTable describes an archive table in the database
+type ArchiveTable struct {
+	Name      string
+	Table     string // Name of the archived table, may be truncated
+	CreatedAt time.Time
+}
+
+// archiveTableName returns the archive table name of a table for a run, timestamped in UTC
+// like the dates of Airflow, truncating the table name to fit the identifier length limit
+func archiveTableName(table string, startAt time.Time) string {
+	suffix := "__" + startAt.UTC().Format(archiveTimestampFormat)
+	if maxLen := maxIdentifierLength - len(ArchiveTablePrefix) - len(suffix); len(table) > maxLen {
+		table = table[:maxLen]
+	}
+	return ArchiveTablePrefix + table + suffix
+}
+
+// createArchiveTable creates the archive table of a table for the current run,
+// with the same columns as the table and no constraints
+func (c *Cleaner) createArchiveTable(table string) (string, error) {
+	name := archiveTableName(table, c.startAt)
+
+	exists, err := c.db.TableExists(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if archive table exists: %w", err)
+	}
+	if exists {
+		return name, nil
+	}
+
+	createSQL := fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM %s WHERE 1 = 0", c.db.Quote(name), c.db.Quote(table))
+	if _, err := c.db.Exec(createSQL); err != nil {
+		return "", err
+	}
+
+	log.Printf("Archiving records of table %s to table %s", table, name)
+	return name, nil
+}
+
+// copyByKeys copies the records with the given primary key values to the archive table
+func (c *Cleaner) copyByKeys(db execer, table, archiveTable string, quotedPK []string, keys [][]interface{}, condition string, args []interface{}) error {
+	for _, cond := range c.keyConditions(quotedPK, keys) {
+		where, whereArgs := recheckCondition(cond, condition, args)
+		copySQL := fmt.Sprintf("INSERT INTO %s SELECT * FROM %s WHERE %s",
+			c.db.Quote(archiveTable), c.db.Quote(table), where)
+		if _, err := db.Exec(copySQL, whereArgs...); err != nil {
+			return fmt.Errorf("failed to archive records: %w", err)
+		}
+	}
+	return nil
+}
+
+// ListArchiveTables lists the archive tables in the database, oldest first
+func (c *Cleaner) ListArchiveTables() ([]ArchiveTable, error) {
+	tables, err := c.db.Tables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+
+	var archives []ArchiveTable
+	for _, name := range tables {
+		match := archiveTablePattern.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		createdAt, err := time.ParseInLocation(archiveTimestampFormat, match[2], time.UTC)
+		if err != nil {
+			continue
+		}
+		archives = append(archives, ArchiveTable{Name: name, Table: match[1], CreatedAt: createdAt})
+	}
+
+	sort.Slice(archives, func(i, j int) bool {
+		if archives[i].CreatedAt.Equal(archives[j].CreatedAt) {
+			return strings.Compare(archives[i].Name, archives[j].Name) < 0
+		}
+		return archives[i].CreatedAt.Before(archives[j].CreatedAt)
+	})
+	return archives, nil
+}
+
+// DropArchiveTables drops the archive tables created more than olderThan ago
+// and returns them; in dry run mode the tables are only returned
+func (c *Cleaner) DropArchiveTables(olderThan time.Duration) ([]ArchiveTable, error) {
+	archives, err := c.ListArchiveTables()
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var dropped []ArchiveTable
+	for _, archive := range archives {
+		if !archive.CreatedAt.Before(cutoff) {
+			continue
+		}
+
+		if c.config.DryRun {
+			log.Printf("Dry run mode: Would drop archive table %s", archive.Name)
+		} else {
+			if _, err := c.db.Exec(fmt.Sprintf("DROP TABLE %s", c.db.Quote(archive.Name))); err != nil {
+				return dropped, fmt.Errorf("failed to drop archive table %s: %w", archive.Name, err)
+			}
+			log.Printf("Dropped archive table %s", archive.Name)
+		}
+		dropped = append(dropped, archive)
+	}
+	return dropped, nil
+}
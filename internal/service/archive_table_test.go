@@ -0,0 +1,164 @@
+package service
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+func TestArchiveTableName(t *testing.T) {
+	startAt := time.Date(2024, 6, 1, 10, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	if name := archiveTableName("dag_run", startAt); name != "_airflow_deleted__dag_run__20240601020000" {
+		t.Errorf("archive table name %s, expected the UTC start time _airflow_deleted__dag_run__20240601020000", name)
+	}
+
+	name := archiveTableName(strings.Repeat("t", 80), startAt)
+	if len(name) != maxIdentifierLength || !strings.HasSuffix(name, "__20240601020000") {
+		t.Errorf("archive table name %s of a long table does not fit %d characters with its timestamp", name, maxIdentifierLength)
+	}
+}
+
+// Archive tables are dated by their UTC timestamp whatever the local time zone
+func TestListArchiveTables(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+	c.config.Archive.Mode = models.ArchiveModeTable
+	c.startAt = time.Now().Add(-2 * time.Hour).In(time.FixedZone("EST", -5*3600))
+
+	if err := c.cleanTableByPK(testTable(t, c, "log")); err != nil {
+		t.Fatalf("failed to clean table log: %v", err)
+	}
+	archives, err := c.ListArchiveTables()
+	if err != nil {
+		t.Fatalf("failed to list archive tables: %v", err)
+	}
+	if len(archives) != 1 || archives[0].Table != "log" || !archives[0].CreatedAt.Equal(c.startAt.Truncate(time.Second)) {
+		t.Fatalf("archive tables %+v, expected one of table log created at %s", archives, c.startAt)
+	}
+	if n := countRows(t, db, archives[0].Name, ""); n != 12 {
+		t.Errorf("archive table %s has %d records, expected 12", archives[0].Name, n)
+	}
+
+	for _, tt := range []struct {
+		olderThan time.Duration
+		dropped   int
+	}{{3 * time.Hour, 0}, {time.Hour, 1}} {
+		dropped, err := c.DropArchiveTables(tt.olderThan)
+		if err != nil {
+			t.Fatalf("failed to drop archive tables: %v", err)
+		}
+		if len(dropped) != tt.dropped {
+			t.Errorf("dropped %d archive tables older than %s, expected %d", len(dropped), tt.olderThan, tt.dropped)
+		}
+	}
+}
+
+// Records the database deletes by cascade with the cleaned runs are archived with them, and
+// restored parents first
+func TestArchiveCascades(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		clean func(*Cleaner, models.TableConfig) error
+	}{
+		{"primary key to table", models.ArchiveModeTable, (*Cleaner).cleanTableByPK},
+		{"primary key to file", models.ArchiveModeFile, (*Cleaner).cleanTableByPK},
+		{"pk_range to table", models.ArchiveModeTable, (*Cleaner).cleanTableByPKRange},
+		{"pk_range to file", models.ArchiveModeFile, (*Cleaner).cleanTableByPKRange},
+		{"date_window to table", models.ArchiveModeTable, (*Cleaner).cleanTableByDateWindow},
+		{"date_window to file", models.ArchiveModeFile, (*Cleaner).cleanTableByDateWindow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			seedTestDB(t, db)
+			c := newTestCleaner(t, db)
+			c.config.Archive.Mode = tt.mode
+
+			if err := tt.clean(c, testTable(t, c, "dag_run")); err != nil {
+				t.Fatalf("failed to clean table dag_run: %v", err)
+			}
+			if err := c.closeArchives(); err != nil {
+				t.Fatalf("failed to close archives: %v", err)
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 9, "dag_run_note": 9, "task_instance": 18, "xcom": 18,
+				"rendered_task_instance_fields": 18})
+
+			for _, archive := range []struct {
+				table    string
+				restored int
+			}{{"dag_run", 11}, {"dag_run_note", 11}, {"task_instance", 22}, {"xcom", 22}, {"rendered_task_instance_fields", 22}} {
+				source := archiveTableName(archive.table, c.startAt)
+				if tt.mode == models.ArchiveModeFile {
+					source = filepath.Join(c.config.Archive.Directory, archiveFileName(archive.table, c.startAt, c.config.Archive.Format))
+				}
+				result, err := c.Restore(RestoreOptions{Source: source})
+				if err != nil {
+					t.Fatalf("failed to restore %s: %v", source, err)
+				}
+				if result.Restored != archive.restored || result.Conflicts != 0 {
+					t.Errorf("restored %d records of %s with %d conflicts, expected %d without conflict",
+						result.Restored, source, result.Conflicts, archive.restored)
+				}
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 20, "dag_run_note": 20, "task_instance": 40, "xcom": 40,
+				"rendered_task_instance_fields": 40})
+		})
+	}
+}
+
+// Task reschedules referencing task instances by ti_id, as in Airflow 3, cannot be matched to
+// runs; run_cascade archives them when the database deletes them with their task instances
+func TestArchiveRunCascadeByTaskInstance(t *testing.T) {
+	for _, mode := range []string{models.ArchiveModeTable, models.ArchiveModeFile} {
+		t.Run(mode, func(t *testing.T) {
+			db := newTestDB(t)
+			seedTestDB(t, db)
+			mustExec(t, db, "ALTER TABLE task_instance ADD COLUMN id VARCHAR(36)")
+			mustExec(t, db, "UPDATE task_instance SET id = dag_id || '/' || run_id || '/' || task_id")
+			mustExec(t, db, "CREATE UNIQUE INDEX ti_id ON task_instance (id)")
+			mustExec(t, db, `CREATE TABLE task_reschedule (
+				id INTEGER NOT NULL PRIMARY KEY,
+				ti_id VARCHAR(36) NOT NULL,
+				reschedule_date TIMESTAMP NOT NULL,
+				FOREIGN KEY (ti_id) REFERENCES task_instance (id) ON DELETE CASCADE
+			)`)
+			mustExec(t, db, "INSERT INTO task_reschedule (ti_id, reschedule_date) SELECT id, queued_dttm FROM task_instance")
+			c := newTestCleaner(t, db)
+			c.config.Archive.Mode = mode
+			dagRun := testTable(t, c, "dag_run")
+			dagRun.Strategy = models.StrategyRunCascade
+
+			if err := c.cleanRunCascade(dagRun); err != nil {
+				t.Fatalf("failed to clean table dag_run: %v", err)
+			}
+			if err := c.closeArchives(); err != nil {
+				t.Fatalf("failed to close archives: %v", err)
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 9, "task_instance": 18, "task_reschedule": 18})
+
+			for _, archive := range []struct {
+				table    string
+				restored int
+			}{{"dag_run", 11}, {"task_instance", 22}, {"task_reschedule", 22}} {
+				source := archiveTableName(archive.table, c.startAt)
+				if mode == models.ArchiveModeFile {
+					source = filepath.Join(c.config.Archive.Directory, archiveFileName(archive.table, c.startAt, c.config.Archive.Format))
+				}
+				result, err := c.Restore(RestoreOptions{Source: source})
+				if err != nil {
+					t.Fatalf("failed to restore %s: %v", source, err)
+				}
+				if result.Restored != archive.restored || result.Conflicts != 0 {
+					t.Errorf("restored %d records of %s with %d conflicts, expected %d without conflict",
+						result.Restored, source, result.Conflicts, archive.restored)
+				}
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 20, "task_instance": 40, "task_reschedule": 40})
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+func TestArchiveFileName(t *testing.T) {
+	startAt := time.Date(2024, 6, 1, 10, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	if name := archiveFileName("dag_run", startAt, models.ArchiveFormatJSONL); name != "dag_run__20240601020000.jsonl.gz" {
+		t.Errorf("archive file name %s, expected the UTC start time dag_run__20240601020000.jsonl.gz", name)
+	}
+}
+
+// readArchiveFile reads the lines of an archive file, up to the last flushed batch when the
+// gzip stream is not finished yet
+func readArchiveFile(t *testing.T, path string) []string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open archive file: %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("failed to read archive file: %v", err)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(gz)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatalf("failed to read archive file: %v", err)
+	}
+	return lines
+}
+
+// Binary columns are base64-encoded, times written in RFC 3339 and NULL kept as null or \N
+func TestFileArchiveContent(t *testing.T) {
+	for _, format := range []string{models.ArchiveFormatJSONL, models.ArchiveFormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			db := newTestDB(t)
+			seedTestDB(t, db)
+			c := newTestCleaner(t, db)
+			c.config.Archive.Mode = models.ArchiveModeFile
+			c.config.Archive.Format = format
+
+			for _, name := range []string{"xcom", "log"} {
+				if err := c.cleanTableByPK(testTable(t, c, name)); err != nil {
+					t.Fatalf("failed to clean table %s: %v", name, err)
+				}
+			}
+			if err := c.closeArchives(); err != nil {
+				t.Fatalf("failed to close archives: %v", err)
+			}
+
+			records := make(map[string][]map[string]interface{})
+			for _, name := range []string{"xcom", "log"} {
+				path := filepath.Join(c.config.Archive.Directory, archiveFileName(name, c.startAt, format))
+				lines := readArchiveFile(t, path)
+				if format == models.ArchiveFormatJSONL {
+					for _, line := range lines {
+						var record map[string]interface{}
+						if err := json.Unmarshal([]byte(line), &record); err != nil {
+							t.Fatalf("invalid JSON line %s: %v", line, err)
+						}
+						records[name] = append(records[name], record)
+					}
+					continue
+				}
+
+				f, err := os.Open(path)
+				if err != nil {
+					t.Fatalf("failed to open archive file: %v", err)
+				}
+				gz, err := gzip.NewReader(f)
+				if err != nil {
+					t.Fatalf("failed to read archive file: %v", err)
+				}
+				rows, err := csv.NewReader(gz).ReadAll()
+				f.Close()
+				if err != nil {
+					t.Fatalf("failed to read CSV archive: %v", err)
+				}
+				for _, row := range rows[1:] {
+					record := make(map[string]interface{}, len(row))
+					for i, column := range rows[0] {
+						record[column] = row[i]
+					}
+					records[name] = append(records[name], record)
+				}
+			}
+
+			if len(records["xcom"]) != 24 || len(records["log"]) != 12 {
+				t.Fatalf("archived %d xcom and %d log records, expected 24 and 12", len(records["xcom"]), len(records["log"]))
+			}
+			if value := records["xcom"][0]["value"]; value != "Im9rIg==" {
+				t.Errorf("binary value archived as %v, expected base64 Im9rIg==", value)
+			}
+			dttm, ok := records["log"][0]["dttm"].(string)
+			if _, err := time.Parse(time.RFC3339Nano, dttm); !ok || err != nil {
+				t.Errorf("time archived as %v, expected RFC 3339", records["log"][0]["dttm"])
+			}
+			null := interface{}(nil)
+			if format == models.ArchiveFormatCSV {
+				null = csvNull
+			}
+			if taskID := records["log"][0]["task_id"]; taskID != null {
+				t.Errorf("NULL archived as %q, expected %v", taskID, null)
+			}
+		})
+	}
+}
+
+// Each batch is flushed to the archive file before its delete runs: when the delete fails,
+// the batch is readable from the file and still in the table
+func TestFileArchiveWrittenBeforeDelete(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+	c.config.Archive.Mode = models.ArchiveModeFile
+	mustExec(t, db, "CREATE TRIGGER log_delete BEFORE DELETE ON log BEGIN SELECT RAISE(ABORT, 'delete refused'); END")
+
+	if err := c.cleanTableByPK(testTable(t, c, "log")); err == nil {
+		t.Fatalf("cleaned table log, expected the delete to fail")
+	}
+	lines := readArchiveFile(t, filepath.Join(c.config.Archive.Directory, archiveFileName("log", c.startAt, models.ArchiveFormatJSONL)))
+	if len(lines) != c.config.BatchSize {
+		t.Errorf("%d records in the archive file, expected the first batch of %d", len(lines), c.config.BatchSize)
+	}
+	checkCounts(t, db, map[string]int{"log": 20})
+	if err := c.closeArchives(); err != nil {
+		t.Errorf("failed to close archives: %v", err)
+	}
+}
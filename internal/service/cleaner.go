@@ -1,8 +1,10 @@
 package service
 
 import (
+	"database/sql"
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 	"time"
 
@@ -12,35 +14,65 @@ import (
 
 // Cleaner responsible for cleaning expired data
 type Cleaner struct {
-	db     *database.DB
-	config models.Config
+	db          *database.DB
+	config      models.Config
+	startAt     time.Time               // Start time of the run, used to name archives
+	graph       *dependencyGraph        // Foreign keys between tables, loaded on first use
+	archives    map[string]*fileArchive // Archive files opened during the run, by table
+	primaryKeys map[string][]string     // Primary key columns discovered from the database, by table
 }
 
 // NewCleaner creates a new cleaner
 func NewCleaner(db *database.DB, config models.Config) *Cleaner {
 	return &Cleaner{
-		db:     db,
-		config: config,
+		db:      db,
+		config:  config,
+		startAt: time.Now(),
 	}
 }
 
 // CleanAll cleans all configured tables
-func (c *Cleaner) CleanAll() error {
-	// Prepare table configurations for cleaning
-	tables := []models.TableConfig{
-		{TableName: "dag_run", RetentionDays: c.config.RetentionDays["dag_run"], DateColumn: "execution_date", PrimaryKey: "id"},
-		{TableName: "task_instance", RetentionDays: c.config.RetentionDays["task_instance"], DateColumn: "start_date", PrimaryKey: "dag_id,task_id,run_id,map_index"},
-		{TableName: "xcom", RetentionDays: c.config.RetentionDays["xcom"], DateColumn: "timestamp", PrimaryKey: "dag_id,task_id,run_id,map_index,key"},
-		{TableName: "log", RetentionDays: c.config.RetentionDays["log"], DateColumn: "dttm", PrimaryKey: "id"},
-		{TableName: "job", RetentionDays: c.config.RetentionDays["job"], DateColumn: "end_date", PrimaryKey: "id"},
+func (c *Cleaner) CleanAll() (err error) {
+	// Archive files are shared by the tables cleaned in the run
+	defer func() {
+		if closeErr := c.closeArchives(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	// Tables referencing other tables are cleaned first, so that their records are
+	// not deleted by cascade before being counted and archived
+	tables, err := c.orderedTables()
+	if err != nil {
+		return err
 	}
 
-	// Iterate and clean each table
+	// Iterate and clean each configured table
 	for _, table := range tables {
-		var err error
-		if c.config.UsePrimaryKeyDelete {
+		if !table.Enabled {
+			log.Printf("Table %s is disabled, skipping", table.TableName)
+			continue
+		}
+
+		// Zombie jobs are failed or deleted before the expired jobs are cleaned
+		if c.zombieJobsEnabled(table) {
+			if err := c.cleanZombieJobs(table); err != nil {
+				return fmt.Errorf("failed to clean zombie jobs of table %s: %w", table.TableName, err)
+			}
+		}
+
+		switch c.DeletionMethod(table) {
+		case models.StrategyRunCascade:
+			err = c.cleanRunCascade(table)
+		case models.StrategyPKRange:
+			err = c.cleanTableByPKRange(table)
+		case models.StrategyDateWindow:
+			err = c.cleanTableByDateWindow(table)
+		case models.StrategyCopySwap:
+			err = c.cleanTableByCopySwap(table)
+		case MethodPrimaryKey:
 			err = c.cleanTableByPK(table)
-		} else {
+		default:
 			err = c.cleanTable(table)
 		}
 
@@ -52,282 +84,1086 @@ func (c *Cleaner) CleanAll() error {
 	return nil
 }
 
-// cleanTable cleans expired data from the specified table using the original method
-func (c *Cleaner) cleanTable(table models.TableConfig) error {
-	// Calculate cutoff date
-	cutoffDate := time.Now().AddDate(0, 0, -table.RetentionDays)
-	log.Printf("Preparing to clean table %s with data earlier than %s", table.TableName, cutoffDate.Format("2006-01-02"))
+// Deletion methods of the tables cleaned without strategy
+const (
+	MethodDeleteLimit = "delete_limit" // Batches of DELETE ... LIMIT on the expired records
+	MethodPrimaryKey  = "primary_key"  // Batches of primary keys selected first, then deleted by key
+)
 
-	// Ensure date column exists
-	var columnExists int
-	checkColumnSQL := fmt.Sprintf(`
-		SELECT COUNT(*) 
-		FROM information_schema.columns 
-		WHERE table_schema = DATABASE() 
-		AND table_name = '%s' 
-		AND column_name = '%s'
-	`, table.TableName, table.DateColumn)
-
-	if err := c.db.Get(&columnExists, checkColumnSQL); err != nil {
-		return fmt.Errorf("failed to check if column exists: %w", err)
+// DeletionMethod returns how the expired records of a table are deleted: its strategy when
+// it has one, by primary key when configured or when archiving, which needs to know exactly
+// which records are deleted, and with DELETE ... LIMIT otherwise
+func (c *Cleaner) DeletionMethod(table models.TableConfig) string {
+	switch {
+	case table.Strategy != models.StrategyDefault:
+		return table.Strategy
+	case c.config.UsePrimaryKeyDelete || c.config.Archive.Mode != "":
+		return MethodPrimaryKey
+	default:
+		return MethodDeleteLimit
 	}
+}
 
-	if columnExists == 0 {
-		log.Printf("Warning: Column %s does not exist in table %s, skipping this table", table.DateColumn, table.TableName)
-		return nil
+// cleanTable cleans expired data from the specified table using the original method
+func (c *Cleaner) cleanTable(table models.TableConfig) error {
+	plan, err := c.planTable(table, c.config.DryRun)
+	if err != nil {
+		return err
 	}
-
-	// First get the number of records that match the condition
-	var count int
-	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE `%s` < ?", table.TableName, table.DateColumn)
-	if err := c.db.Get(&count, countQuery, cutoffDate); err != nil {
-		return fmt.Errorf("failed to get record count: %w", err)
+	if plan.Skipped != "" {
+		return nil
 	}
 
-	log.Printf("Will clean %d records from table %s", count, table.TableName)
-
 	// If in dry run mode, stop here
 	if c.config.DryRun {
 		log.Printf("Dry run mode: No actual deletion operations will be performed")
 		return nil
 	}
 
+	deleted, err := c.deleteScopes(table, plan)
+	if err != nil {
+		return err
+	}
+	log.Printf("Successfully cleaned %d records from table %s", deleted, table.TableName)
+	return c.reportCascades(plan)
+}
+
+// deleteScopes deletes the records of every scope of a plan in batches and returns the
+// number of deleted records
+func (c *Cleaner) deleteScopes(table models.TableConfig, plan *TablePlan) (int, error) {
 	// If there are no records to clean, return directly
+	count := plan.Count
 	if count == 0 {
 		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
-		return nil
+		return 0, nil
 	}
 
-	// Delete data in batches
+	// Delete data in batches, scope by scope
 	var deleted int
 	batchSize := c.config.BatchSize
 	// Convert float64 seconds to time.Duration (nanoseconds)
 	sleepDuration := time.Duration(c.config.SleepSeconds * float64(time.Second))
 
-	// Use simple batch deletion method
-	for deleted < count {
-		// Calculate the number of records to delete in this batch
-		currentBatchSize := batchSize
-		if count-deleted < batchSize {
-			currentBatchSize = count - deleted
-		}
+	for _, scope := range plan.Scopes {
+		// Use simple batch deletion method
+		var scopeDeleted int
+		for scopeDeleted < scope.Count {
+			// Calculate the number of records to delete in this batch
+			currentBatchSize := batchSize
+			if scope.Count-scopeDeleted < batchSize {
+				currentBatchSize = scope.Count - scopeDeleted
+			}
 
-		deleteSQL := fmt.Sprintf("DELETE FROM `%s` WHERE `%s` < ? LIMIT %d",
-			table.TableName, table.DateColumn, currentBatchSize)
+			deleteSQL := c.db.Dialect().DeleteLimitSQL(table.TableName, scope.where, currentBatchSize)
 
-		result, err := c.db.Exec(deleteSQL, cutoffDate)
-		if err != nil {
-			return fmt.Errorf("failed to delete records: %w", err)
-		}
+			result, err := c.db.Exec(deleteSQL, scope.args...)
+			if err != nil {
+				return deleted, fmt.Errorf("failed to delete records: %w", err)
+			}
 
-		rowsAffected, _ := result.RowsAffected()
-		deleted += int(rowsAffected)
+			rowsAffected, _ := result.RowsAffected()
+			if rowsAffected == 0 {
+				break // Remaining records were deleted by someone else
+			}
+			scopeDeleted += int(rowsAffected)
+			deleted += int(rowsAffected)
 
-		log.Printf("Deleted %d/%d records from table %s", deleted, count, table.TableName)
+			log.Printf("Deleted %d/%d records from table %s", deleted, count, table.TableName)
 
-		// If not finished deleting, sleep to reduce database pressure
-		if deleted < count {
-			log.Printf("Sleeping for %.3f seconds before continuing deletion...", c.config.SleepSeconds)
-			time.Sleep(sleepDuration)
+			// If not finished deleting, sleep to reduce database pressure
+			if deleted < count {
+				log.Printf("Sleeping for %.3f seconds before continuing deletion...", c.config.SleepSeconds)
+				time.Sleep(sleepDuration)
+			}
 		}
 	}
 
-	log.Printf("Successfully cleaned %d records from table %s", deleted, table.TableName)
-	return nil
+	return deleted, nil
 }
 
 // cleanTableByPK cleans expired data from the specified table using primary key-based deletion
 func (c *Cleaner) cleanTableByPK(table models.TableConfig) error {
-	// Calculate cutoff date
-	cutoffDate := time.Now().AddDate(0, 0, -table.RetentionDays)
-	log.Printf("Preparing to clean table %s with data earlier than %s (using PK-based method)",
-		table.TableName, cutoffDate.Format("2006-01-02"))
-
-	// Validate required fields
-	if table.PrimaryKey == "" {
-		return fmt.Errorf("primary key not specified for table %s", table.TableName)
-	}
-
-	// Ensure date column exists
-	var columnExists int
-	checkColumnSQL := fmt.Sprintf(`
-		SELECT COUNT(*) 
-		FROM information_schema.columns 
-		WHERE table_schema = DATABASE() 
-		AND table_name = '%s' 
-		AND column_name = '%s'
-	`, table.TableName, table.DateColumn)
-
-	if err := c.db.Get(&columnExists, checkColumnSQL); err != nil {
-		return fmt.Errorf("failed to check if column exists: %w", err)
+	log.Printf("Cleaning table %s using PK-based method", table.TableName)
+	plan, err := c.planTable(table, c.config.DryRun)
+	if err != nil {
+		return err
 	}
-
-	if columnExists == 0 {
-		log.Printf("Warning: Column %s does not exist in table %s, skipping this table", table.DateColumn, table.TableName)
+	if plan.Skipped != "" {
 		return nil
 	}
-
-	// First get the number of records that match the condition
-	var count int
-	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM `%s` WHERE `%s` < ?", table.TableName, table.DateColumn)
-	if err := c.db.Get(&count, countQuery, cutoffDate); err != nil {
-		return fmt.Errorf("failed to get record count: %w", err)
+	pk, err := c.primaryKey(table)
+	if err != nil {
+		return err
 	}
 
-	log.Printf("Will clean %d records from table %s", count, table.TableName)
-
 	// If in dry run mode, stop here
 	if c.config.DryRun {
 		log.Printf("Dry run mode: No actual deletion operations will be performed")
 		return nil
 	}
 
+	// Records of other tables deleted by cascade are archived with the batches
+	var cascades []cascadeArchive
+	if plan.Count > 0 {
+		if cascades, err = c.cascadeArchives(table.TableName, nil); err != nil {
+			return err
+		}
+	}
+	deleted, err := c.deleteScopesByPK(table, plan, pk, cascades)
+	if err != nil {
+		return err
+	}
+	log.Printf("Successfully cleaned %d records from table %s", deleted, table.TableName)
+	return c.reportCascades(plan)
+}
+
+// deleteScopesByPK deletes the records of every scope of a plan in batches by primary key,
+// archiving them first with the records of the cascades when archiving is enabled, and
+// returns the number of deleted records
+func (c *Cleaner) deleteScopesByPK(table models.TableConfig, plan *TablePlan, pk []string, cascades []cascadeArchive) (int, error) {
 	// If there are no records to clean, return directly
+	count := plan.Count
 	if count == 0 {
 		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
-		return nil
+		return 0, nil
 	}
 
 	// Delete data in batches
 	var deleted int
+	var err error
 	batchSize := c.config.BatchSize
 	sleepDuration := time.Duration(c.config.SleepSeconds * float64(time.Second))
-	pk := strings.Split(table.PrimaryKey, ",")
+	quotedPK := make([]string, len(pk))
+	for i, col := range pk {
+		quotedPK[i] = c.db.Quote(col)
+	}
 
-	for deleted < count {
-		// Calculate actual batch size for this iteration
-		currentBatchSize := batchSize
-		if count-deleted < batchSize {
-			currentBatchSize = count - deleted
+	// Open the archive the deleted records are written to
+	var archive *fileArchive
+	if c.config.Archive.Mode == models.ArchiveModeFile {
+		if archive, err = c.tableArchive(table.TableName); err != nil {
+			return deleted, err
 		}
+	}
+	var archiveTable string
+	if c.config.Archive.Mode == models.ArchiveModeTable {
+		archiveTable, err = c.createArchiveTable(table.TableName)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to create archive table: %w", err)
+		}
+	}
 
-		startTime := time.Now()
+	// Records of other tables deleted by cascade are archived with the batch
+	qualifiedPK := make([]string, len(pk))
+	for i, col := range quotedPK {
+		qualifiedPK[i] = c.db.Quote(table.TableName) + "." + col
+	}
+	archiveCascades := func(db execer, keys [][]interface{}) error {
+		for _, cond := range c.keyConditions(qualifiedPK, keys) {
+			if err := c.archiveCascades(db, table.TableName, cascades, cond.sql, cond.args); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 
-		// First query: get primary keys of records to delete
-		// If multi-column primary key, select them all
-		pkSelectSQL := fmt.Sprintf("SELECT %s FROM `%s` WHERE `%s` < ? ORDER BY %s LIMIT %d",
-			table.PrimaryKey, table.TableName, table.DateColumn, pk[0], currentBatchSize)
+	orderBy := strings.Join(quotedPK, ", ")
+	for _, scope := range plan.Scopes {
+		// Each batch continues after the last key of the previous one instead of scanning
+		// the scope again from its start
+		var scopeDeleted int
+		var lastKey []interface{}
+		for scopeDeleted < scope.Count {
+			// Calculate actual batch size for this iteration
+			currentBatchSize := batchSize
+			if scope.Count-scopeDeleted < batchSize {
+				currentBatchSize = scope.Count - scopeDeleted
+			}
 
-		// For composite keys, we'll read the rows into a map of string->interface{}
-		rows, err := c.db.Queryx(pkSelectSQL, cutoffDate)
-		if err != nil {
-			return fmt.Errorf("failed to query primary keys: %w", err)
-		}
+			startTime := time.Now()
 
-		// Prepare for batch deletion
-		var batchDeleted int
+			// First query: get primary keys of records to delete
+			// If multi-column primary key, select them all; when archiving, select whole rows
+			selectColumns := strings.Join(quotedPK, ", ")
+			if archive != nil {
+				selectColumns = "*"
+			}
+			where, args := scope.where, scope.args
+			if lastKey != nil {
+				after, afterArgs := c.keysetCondition(quotedPK, lastKey)
+				where = fmt.Sprintf("(%s) AND %s", where, after)
+				args = append(append([]interface{}{}, args...), afterArgs...)
+			}
+			pkSelectSQL := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT %d",
+				selectColumns, c.db.Quote(table.TableName), where, orderBy, currentBatchSize)
 
-		// Handle different primary key scenarios
-		if len(pk) == 1 {
-			// Single column primary key
-			var ids []interface{}
-			for rows.Next() {
-				var id interface{}
-				if err := rows.Scan(&id); err != nil {
-					rows.Close()
-					return fmt.Errorf("failed to scan primary key: %w", err)
-				}
-				ids = append(ids, id)
+			batch, err := c.fetchBatch(pkSelectSQL, pk, args...)
+			if err != nil {
+				return deleted, err
 			}
-			rows.Close()
+			selectDuration := time.Since(startTime)
 
-			if len(ids) == 0 {
+			if len(batch.keys) == 0 {
 				break // No more records to delete
 			}
+			lastKey = cursorKey(batch.keys[len(batch.keys)-1])
 
-			// Build placeholders for IN clause
-			placeholders := strings.Repeat("?,", len(ids))
-			placeholders = placeholders[:len(placeholders)-1] // Remove trailing comma
-
-			// Delete using primary key
-			deleteSQL := fmt.Sprintf("DELETE FROM `%s` WHERE `%s` IN (%s)",
-				table.TableName, pk[0], placeholders)
+			// Archive the batch before it is deleted
+			if archive != nil {
+				if err := archive.WriteBatch(batch.columns, batch.types, batch.rows); err != nil {
+					return deleted, fmt.Errorf("failed to archive records: %w", err)
+				}
+				if err := archiveCascades(c.db, batch.keys); err != nil {
+					return deleted, err
+				}
+			}
 
-			result, err := c.db.Exec(deleteSQL, ids...)
+			// Delete the batch, copying it to the archive table in the same transaction
+			var recheck string
+			var recheckArgs []interface{}
+			if scope.recheck {
+				recheck, recheckArgs = scope.where, scope.args
+			}
+			var batchDeleted int
+			if archiveTable != "" {
+				err = c.db.Transaction(func(tx *database.Tx) error {
+					if err := archiveCascades(tx, batch.keys); err != nil {
+						return err
+					}
+					if err := c.copyByKeys(tx, table.TableName, archiveTable, quotedPK, batch.keys, recheck, recheckArgs); err != nil {
+						return err
+					}
+					n, err := c.deleteByKeys(tx, table.TableName, quotedPK, batch.keys, recheck, recheckArgs)
+					batchDeleted = n
+					return err
+				})
+			} else {
+				batchDeleted, err = c.deleteByKeys(c.db, table.TableName, quotedPK, batch.keys, recheck, recheckArgs)
+			}
 			if err != nil {
-				return fmt.Errorf("failed to delete records: %w", err)
+				return deleted, err
 			}
 
-			rowsAffected, _ := result.RowsAffected()
-			batchDeleted = int(rowsAffected)
-		} else {
-			// Composite primary key - handle differently
-			// We'll do one deletion per row to avoid complex WHERE clauses
+			scopeDeleted += batchDeleted
+			deleted += batchDeleted
+
+			// Calculate execution time for this batch
+			batchDuration := time.Since(startTime)
+			log.Printf("Deleted %d/%d records from table %s (batch time: %.2fs, select: %.2fs, delete: %.2fs)",
+				deleted, count, table.TableName, batchDuration.Seconds(), selectDuration.Seconds(),
+				(batchDuration - selectDuration).Seconds())
 
-			type CompositeKey struct {
-				Values []interface{}
+			// If not finished deleting, sleep to reduce database pressure
+			if deleted < count {
+				log.Printf("Sleeping for %.3f seconds before continuing deletion...", c.config.SleepSeconds)
+				time.Sleep(sleepDuration)
 			}
+		}
+	}
 
-			var keys []CompositeKey
-			for rows.Next() {
-				// Scan into a map
-				rowMap := make(map[string]interface{})
-				if err := rows.MapScan(rowMap); err != nil {
-					rows.Close()
-					return fmt.Errorf("failed to scan composite key: %w", err)
-				}
+	return deleted, nil
+}
 
-				// Extract values in the right order
-				var keyValues []interface{}
-				for _, col := range pk {
-					keyValues = append(keyValues, rowMap[col])
-				}
+// TablePlan describes the expired records of a table
+type TablePlan struct {
+	Table  string
+	Cutoff time.Time
+	Count  int // Number of expired records over all scopes
+	// Number of expired records dated by a fallback date column
+	FallbackCount int
+	Skipped       string      // Reason the table is skipped, empty otherwise
+	Scopes        []ScopePlan // Expired records per retention scope, overrides first
+	// Records of other tables deleted by cascade with the expired records
+	Cascades []CascadePlan
+	// Zombie jobs failed or deleted before the expired records, nil when not handled
+	Zombies *ZombiePlan
+}
 
-				keys = append(keys, CompositeKey{Values: keyValues})
+// ScopePlan describes the expired records of a table under one retention:
+// the records of the DAGs matching a dag_id override, the records in a state
+// with its own retention, or the other records
+type ScopePlan struct {
+	Override      string // dag_id pattern of the override, empty for the table retention
+	State         string // State with its own retention, empty for the other states
+	RetentionDays int
+	Cutoff        time.Time
+	Count         int
+	FallbackCount int // Expired records dated by a fallback date column
+
+	where string        // Condition matching the expired records of the scope
+	args  []interface{} // Arguments of the condition
+	// Repeat the condition in the deletes by primary key, for records that can stop
+	// matching it once selected, such as zombie jobs that heartbeat again
+	recheck bool
+}
+
+// Plan counts the expired records of every enabled table without deleting anything
+func (c *Cleaner) Plan() ([]TablePlan, error) {
+	tables, err := c.orderedTables()
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []TablePlan
+	for _, table := range tables {
+		if !table.Enabled {
+			continue
+		}
+		plan, err := c.planTable(table, true)
+		if err != nil {
+			return plans, fmt.Errorf("failed to plan table %s: %w", table.TableName, err)
+		}
+		if plan.Skipped == "" && c.zombieJobsEnabled(table) {
+			if plan.Zombies, err = c.planZombieJobs(table, true); err != nil {
+				return plans, fmt.Errorf("failed to plan zombie jobs of table %s: %w", table.TableName, err)
 			}
-			rows.Close()
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, nil
+}
 
-			if len(keys) == 0 {
-				break // No more records to delete
+// planTable checks the date column of a table and counts its expired records,
+// dryRun tells whether the tables cleaned before are left untouched
+func (c *Cleaner) planTable(table models.TableConfig, dryRun bool) (*TablePlan, error) {
+	// Calculate cutoff date
+	now := time.Now()
+	cutoffDate := now.AddDate(0, 0, -table.RetentionDays)
+	log.Printf("Preparing to clean table %s with data earlier than %s", table.TableName, cutoffDate.Format("2006-01-02"))
+	plan := &TablePlan{Table: table.TableName, Cutoff: cutoffDate}
+
+	// Ensure date column exists
+	dateTable := dateTableName(table)
+	columnExists, err := c.db.ColumnExists(dateTable, table.DateColumn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if column exists: %w", err)
+	}
+
+	// Tables of other Airflow versions may not exist at all, even when the table
+	// holding their date does
+	if !columnExists || table.DateJoin != nil {
+		tableExists, err := c.db.TableExists(table.TableName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if table exists: %w", err)
+		}
+		if !tableExists {
+			log.Printf("Warning: Table %s does not exist, skipping this table", table.TableName)
+			plan.Skipped = fmt.Sprintf("table %s does not exist", table.TableName)
+			return plan, nil
+		}
+	}
+	if !columnExists {
+		// Cleaning an existing table by a wrong column would silently keep its records
+		return nil, fmt.Errorf("column %s does not exist in table %s, check that the table preset matches the Airflow version",
+			table.DateColumn, dateTable)
+	}
+
+	// Records without date column value are dated by the first non-NULL fallback column
+	dateColumns, err := c.dateColumns(table)
+	if err != nil {
+		return nil, err
+	}
+	if len(dateColumns) <= len(table.FallbackDateColumns) {
+		log.Printf("Warning: Some fallback date columns of table %s do not exist in table %s, using %s",
+			table.TableName, dateTable, strings.Join(dateColumns, ", "))
+	}
+
+	// Get the number of records that match the condition of each scope
+	if plan.Scopes, err = c.retentionScopes(table, now); err != nil {
+		return nil, err
+	}
+	for i := range plan.Scopes {
+		scope := &plan.Scopes[i]
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", c.db.Quote(table.TableName), scope.where)
+		if err := c.db.Get(&scope.Count, countQuery, scope.args...); err != nil {
+			return nil, fmt.Errorf("failed to get record count: %w", err)
+		}
+		if len(dateColumns) > 1 && scope.Count > 0 {
+			countQuery += fmt.Sprintf(" AND %s IS NULL", c.dateValue(table, dateColumns[:1]))
+			if err := c.db.Get(&scope.FallbackCount, countQuery, scope.args...); err != nil {
+				return nil, fmt.Errorf("failed to get record count: %w", err)
 			}
+			plan.FallbackCount += scope.FallbackCount
+		}
+		if scope.Override != "" {
+			log.Printf("DAGs matching %s: %d records older than %d days in table %s",
+				scope.Override, scope.Count, scope.RetentionDays, table.TableName)
+		} else if scope.State != "" {
+			log.Printf("State %s: %d records older than %d days in table %s",
+				scope.State, scope.Count, scope.RetentionDays, table.TableName)
+		}
+		plan.Count += scope.Count
+	}
 
-			// Build WHERE clause for composite key
-			// For example: (col1 = ? AND col2 = ? AND col3 = ?) OR (col1 = ? AND col2 = ? AND col3 = ?) ...
-			var whereClauseParts []string
-			var allParams []interface{}
+	log.Printf("Will clean %d records from table %s", plan.Count, table.TableName)
+	if plan.FallbackCount > 0 {
+		log.Printf("%d of them have no %s and are dated by %s", plan.FallbackCount, table.DateColumn,
+			strings.Join(dateColumns[1:], ", "))
+	}
 
-			for i, key := range keys {
-				var conditions []string
-				for j, col := range pk {
-					conditions = append(conditions, fmt.Sprintf("`%s` = ?", col))
-					allParams = append(allParams, key.Values[j])
-				}
-				whereClauseParts = append(whereClauseParts, "("+strings.Join(conditions, " AND ")+")")
+	// Count the records of other tables deleted by cascade, or with the runs
+	if plan.Count > 0 {
+		condition, args := combineScopes(plan.Scopes)
+		if table.Strategy == models.StrategyRunCascade {
+			plan.Cascades, err = c.planRunDependents(condition, args, dryRun)
+		} else {
+			plan.Cascades, err = c.planCascades(table.TableName, condition, args, map[string]bool{table.TableName: true}, dryRun)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, cascade := range plan.Cascades {
+			if cascade.Count > 0 {
+				log.Printf("Will delete %d records from table %s by cascade from table %s", cascade.Count, cascade.Table, cascade.Parent)
+			}
+		}
+	}
+	return plan, nil
+}
 
-				// For very large batches, limit the size of a single DELETE query
-				if len(whereClauseParts) >= 100 || i == len(keys)-1 {
-					whereClause := strings.Join(whereClauseParts, " OR ")
-					deleteSQL := fmt.Sprintf("DELETE FROM `%s` WHERE %s", table.TableName, whereClause)
+// combineScopes builds the condition matching the expired records of all scopes
+func combineScopes(scopes []ScopePlan) (string, []interface{}) {
+	conditions := make([]string, len(scopes))
+	var args []interface{}
+	for i, scope := range scopes {
+		conditions[i] = "(" + scope.where + ")"
+		args = append(args, scope.args...)
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", args
+}
 
-					result, err := c.db.Exec(deleteSQL, allParams...)
-					if err != nil {
-						return fmt.Errorf("failed to delete records with composite key: %w", err)
-					}
+// retentionScopes builds the retention scopes of a table: one per dag_id override
+// of the table, matching the DAGs of its pattern not matched by an earlier override,
+// then one per state with its own retention for the records of the other DAGs, and
+// finally one for the remaining records with the table retention. Records in excluded
+// states, or dated by a DAG run in an excluded state, are left out of every scope.
+func (c *Cleaner) retentionScopes(table models.TableConfig, now time.Time) ([]ScopePlan, error) {
+	// Records in excluded states are never cleaned
+	state := c.db.Quote("state")
+	var exclusion string
+	var exclusionArgs []interface{}
+	if len(table.ExcludedStates) > 0 {
+		if err := c.requireColumn(table.TableName, "state", "excluded states"); err != nil {
+			return nil, err
+		}
+		exclusion, exclusionArgs = notInCondition(state, table.ExcludedStates)
+	}
 
-					rowsAffected, _ := result.RowsAffected()
-					batchDeleted += int(rowsAffected)
+	// Records dated by their DAG run are kept with the runs never cleaned
+	if keptRuns, keptRunsArgs := c.keptRunStatesCondition(table); keptRuns != "" {
+		if exclusion != "" {
+			exclusion += " AND "
+		}
+		exclusion += keptRuns
+		exclusionArgs = append(exclusionArgs, keptRunsArgs...)
+	}
 
-					// Reset for next batch
-					whereClauseParts = nil
-					allParams = nil
-				}
+	// newScope builds the scope of the records matching condition, older than days
+	newScope := func(override, scopeState string, days int, condition string, args []interface{}) (ScopePlan, error) {
+		cutoff := now.AddDate(0, 0, -days)
+		where, expiredArgs, err := c.expiredCondition(table, cutoff)
+		if err != nil {
+			return ScopePlan{}, err
+		}
+		var scopeArgs []interface{}
+		if condition != "" {
+			where = condition + " AND " + where
+			scopeArgs = append(scopeArgs, args...)
+		}
+		scopeArgs = append(scopeArgs, expiredArgs...)
+		if exclusion != "" {
+			where += " AND " + exclusion
+			scopeArgs = append(scopeArgs, exclusionArgs...)
+		}
+		return ScopePlan{
+			Override:      override,
+			State:         scopeState,
+			RetentionDays: days,
+			Cutoff:        cutoff,
+			where:         where,
+			args:          scopeArgs,
+		}, nil
+	}
+
+	var scopes []ScopePlan
+	var others []string          // Conditions matching the records not in the scopes so far
+	var othersArgs []interface{} // Arguments of these conditions
+
+	if len(table.DagOverrides) > 0 {
+		if err := c.requireColumn(table.TableName, "dag_id", "dag_id overrides"); err != nil {
+			return nil, err
+		}
+
+		var matched []string          // Conditions of the earlier overrides
+		var matchedArgs []interface{} // Arguments of the conditions of the earlier overrides
+		for _, override := range table.DagOverrides {
+			match, pattern := c.db.GlobMatch(c.db.Quote("dag_id"), override.DagPattern)
+			where := match
+			args := []interface{}{pattern}
+			if len(matched) > 0 {
+				where += " AND NOT (" + strings.Join(matched, " OR ") + ")"
+				args = append(args, matchedArgs...)
+			}
+			scope, err := newScope(override.DagPattern, "", override.RetentionDays, where, args)
+			if err != nil {
+				return nil, err
 			}
+			scopes = append(scopes, scope)
+
+			matched = append(matched, match)
+			matchedArgs = append(matchedArgs, pattern)
 		}
 
-		deleted += batchDeleted
+		// Records without dag_id do not match any override
+		others = append(others, fmt.Sprintf("(%s IS NULL OR NOT (%s))", c.db.Quote("dag_id"), strings.Join(matched, " OR ")))
+		othersArgs = append(othersArgs, matchedArgs...)
+	}
+
+	if len(table.StateRetention) > 0 {
+		if err := c.requireColumn(table.TableName, "state", "state retention"); err != nil {
+			return nil, err
+		}
 
-		// Calculate execution time for this batch
-		batchDuration := time.Since(startTime)
-		log.Printf("Deleted %d/%d records from table %s (batch time: %.2fs)",
-			deleted, count, table.TableName, batchDuration.Seconds())
+		states := make([]string, 0, len(table.StateRetention))
+		for name := range table.StateRetention {
+			states = append(states, name)
+		}
+		sort.Strings(states)
 
-		// If not finished deleting, sleep to reduce database pressure
-		if deleted < count {
-			log.Printf("Sleeping for %.3f seconds before continuing deletion...", c.config.SleepSeconds)
-			time.Sleep(sleepDuration)
+		for _, name := range states {
+			where := strings.Join(append(append([]string{}, others...), state+" = ?"), " AND ")
+			args := append(append([]interface{}{}, othersArgs...), name)
+			scope, err := newScope("", name, table.StateRetention[name], where, args)
+			if err != nil {
+				return nil, err
+			}
+			scopes = append(scopes, scope)
 		}
+
+		// Records without state keep the table retention
+		condition, args := notInCondition(state, states)
+		others = append(others, condition)
+		othersArgs = append(othersArgs, args...)
 	}
 
-	log.Printf("Successfully cleaned %d records from table %s", deleted, table.TableName)
+	scope, err := newScope("", "", table.RetentionDays, strings.Join(others, " AND "), othersArgs)
+	if err != nil {
+		return nil, err
+	}
+	return append(scopes, scope), nil
+}
+
+// requireColumn returns an error when a column a feature relies on does not exist in a table
+func (c *Cleaner) requireColumn(table, column, feature string) error {
+	exists, err := c.db.ColumnExists(table, column)
+	if err != nil {
+		return fmt.Errorf("failed to check if column exists: %w", err)
+	}
+	if !exists {
+		return fmt.Errorf("table %s has %s but no %s column", table, feature, column)
+	}
+	return nil
+}
+
+// notInCondition builds a condition matching the records whose column is NULL
+// or none of the given values
+func notInCondition(column string, values []string) (string, []interface{}) {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		args[i] = value
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(values)), ", ")
+	return fmt.Sprintf("(%s IS NULL OR %s NOT IN (%s))", column, column, placeholders), args
+}
+
+// expiredCondition builds the WHERE condition matching the records of a table older than cutoff
+func (c *Cleaner) expiredCondition(table models.TableConfig, cutoff time.Time) (string, []interface{}, error) {
+	columns, err := c.dateColumns(table)
+	if err != nil {
+		return "", nil, err
+	}
+	condition, args := c.dateCondition(table, columns, time.Time{}, cutoff)
+	if table.Condition != "" {
+		condition += " AND (" + table.Condition + ")"
+	}
+
+	keepRuns, err := c.keepRunsCondition(table)
+	if err != nil {
+		return "", nil, err
+	}
+	if keepRuns != "" {
+		condition += " AND " + keepRuns
+	}
+	return condition, args, nil
+}
+
+// dateExpression returns the SQL expression of the date of the records of a table:
+// the first non-NULL of its date columns, in a subquery on the joined table when the
+// table takes its date from another table
+func (c *Cleaner) dateExpression(table models.TableConfig) (string, error) {
+	columns, err := c.dateColumns(table)
+	if err != nil {
+		return "", err
+	}
+	return c.dateValue(table, columns), nil
+}
+
+// dateColumns returns the date column of a table followed by its fallback date
+// columns that exist; fallback columns missing in older schemas are ignored
+func (c *Cleaner) dateColumns(table models.TableConfig) ([]string, error) {
+	columns := []string{table.DateColumn}
+	for _, column := range table.FallbackDateColumns {
+		exists, err := c.db.ColumnExists(dateTableName(table), column)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if column exists: %w", err)
+		}
+		if exists {
+			columns = append(columns, column)
+		}
+	}
+	return columns, nil
+}
+
+// dateValue returns the SQL expression of the first non-NULL of the given date columns of a table
+func (c *Cleaner) dateValue(table models.TableConfig, columns []string) string {
+	prefix := ""
+	if table.DateJoin != nil {
+		prefix = c.db.Quote(table.DateJoin.Table) + "."
+	}
+	dates := make([]string, len(columns))
+	for i, column := range columns {
+		dates[i] = prefix + c.db.Quote(column)
+	}
+	date := dates[0]
+	if len(dates) > 1 {
+		date = fmt.Sprintf("COALESCE(%s)", strings.Join(dates, ", "))
+	}
+	if table.DateJoin == nil {
+		return date
+	}
+
+	return fmt.Sprintf("(SELECT %s FROM %s WHERE %s)", date, c.db.Quote(table.DateJoin.Table), c.dateJoinCondition(table))
+}
+
+// dateCondition builds the condition matching the records of a table dated before end, and
+// from start on unless start is zero. The date column is compared on its own, so that an
+// index on it serves the condition, and the fallback date columns only for the records
+// without it: date < ? OR (date IS NULL AND COALESCE(fallback, ...) < ?).
+func (c *Cleaner) dateCondition(table models.TableConfig, columns []string, start, end time.Time) (string, []interface{}) {
+	prefix := ""
+	if table.DateJoin != nil {
+		prefix = c.db.Quote(table.DateJoin.Table) + "."
+	}
+	var args []interface{}
+	between := func(date string) string {
+		if start.IsZero() {
+			args = append(args, end)
+			return date + " < ?"
+		}
+		args = append(args, start, end)
+		return fmt.Sprintf("%s >= ? AND %s < ?", date, date)
+	}
+
+	date := prefix + c.db.Quote(columns[0])
+	condition := between(date)
+	if len(columns) > 1 {
+		fallbacks := make([]string, len(columns)-1)
+		for i, column := range columns[1:] {
+			fallbacks[i] = prefix + c.db.Quote(column)
+		}
+		fallback := fallbacks[0]
+		if len(fallbacks) > 1 {
+			fallback = fmt.Sprintf("COALESCE(%s)", strings.Join(fallbacks, ", "))
+		}
+		condition = fmt.Sprintf("(%s OR (%s IS NULL AND %s))", condition, date, between(fallback))
+	}
+	if table.DateJoin == nil {
+		return condition, args
+	}
+
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE %s AND %s)", c.db.Quote(table.DateJoin.Table),
+		c.dateJoinCondition(table), condition), args
+}
+
+// dateJoinCondition builds the condition matching the joined record of a table dated by another table
+func (c *Cleaner) dateJoinCondition(table models.TableConfig) string {
+	joined := c.db.Quote(table.DateJoin.Table)
+	quoted := c.db.Quote(table.TableName)
+	referenced := table.DateJoin.ReferencedColumns
+	if len(referenced) == 0 {
+		referenced = table.DateJoin.Columns
+	}
+	conditions := make([]string, len(table.DateJoin.Columns))
+	for i, column := range table.DateJoin.Columns {
+		conditions[i] = fmt.Sprintf("%s.%s = %s.%s", joined, c.db.Quote(referenced[i]), quoted, c.db.Quote(column))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// keptRunStatesCondition builds the condition leaving out the records of a table dated by
+// their DAG run whose run is in a state dag_run never cleans, empty for other tables
+func (c *Cleaner) keptRunStatesCondition(table models.TableConfig) (string, []interface{}) {
+	if table.DateJoin == nil || table.DateJoin.Table != dagRunTable {
+		return "", nil
+	}
+	dagRun, ok := c.tableConfig(dagRunTable)
+	if !ok || len(dagRun.ExcludedStates) == 0 {
+		return "", nil
+	}
+
+	args := make([]interface{}, len(dagRun.ExcludedStates))
+	for i, state := range dagRun.ExcludedStates {
+		args[i] = state
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(args)), ", ")
+	return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s WHERE %s AND %s.%s IN (%s))", c.db.Quote(dagRunTable),
+		c.dateJoinCondition(table), c.db.Quote(dagRunTable), c.db.Quote("state"), placeholders), args
+}
+
+// dateTableName returns the name of the table holding the date column of a table
+func dateTableName(table models.TableConfig) string {
+	if table.DateJoin != nil {
+		return table.DateJoin.Table
+	}
+	return table.TableName
+}
+
+// dagRunTable is the table of DAG runs, whose records are identified by dag_id and run_id
+const dagRunTable = "dag_run"
+
+// keepRunsCondition builds the condition excluding the records of the last
+// KeepLastRunsPerDag runs of each DAG. It applies to dag_run and to every table
+// with dag_id and run_id columns, and is empty for other tables or when disabled.
+func (c *Cleaner) keepRunsCondition(table models.TableConfig) (string, error) {
+	if c.config.KeepLastRunsPerDag <= 0 {
+		return "", nil
+	}
+	for _, column := range []string{"dag_id", "run_id"} {
+		exists, err := c.db.ColumnExists(table.TableName, column)
+		if err != nil {
+			return "", fmt.Errorf("failed to check if column exists: %w", err)
+		}
+		if !exists {
+			return "", nil
+		}
+	}
+
+	// Runs are ranked by the date of dag_run, with its fallback date columns, as it is
+	// cleaned: in Airflow 3 asset-triggered runs have no logical_date but a run_after
+	dagRun, ok := c.tableConfig(dagRunTable)
+	if !ok {
+		dagRun = models.TableConfig{TableName: dagRunTable, DateColumn: "execution_date"}
+	}
+	date, err := c.dateExpression(dagRun)
+	if err != nil {
+		return "", err
+	}
+
+	// A run is kept when it is one of the N latest of its DAG. The kept runs are selected
+	// in a derived table, which MySQL materializes for the window function, as it does not
+	// allow deleting from a table selected in a subquery (error 1093).
+	keptRuns := fmt.Sprintf("SELECT ranked_runs.dag_id, ranked_runs.run_id FROM "+
+		"(SELECT dag_id, run_id, ROW_NUMBER() OVER (PARTITION BY dag_id ORDER BY %s DESC) AS run_rank FROM %s) ranked_runs "+
+		"WHERE ranked_runs.run_rank <= %d",
+		date, c.db.Quote(dagRunTable), c.config.KeepLastRunsPerDag)
+
+	quotedTable := c.db.Quote(table.TableName)
+	return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM (%s) kept_runs "+
+		"WHERE kept_runs.dag_id = %s.dag_id AND kept_runs.run_id = %s.run_id)",
+		keptRuns, quotedTable, quotedTable), nil
+}
+
+// primaryKey discovers the primary key columns of a table from the database, in key order.
+// A configured primary key is only checked against them, so that records are never
+// deleted by a key that is no longer unique after a schema change.
+func (c *Cleaner) primaryKey(table models.TableConfig) ([]string, error) {
+	if pk, ok := c.primaryKeys[table.TableName]; ok {
+		return pk, nil
+	}
+
+	pk, err := c.db.PrimaryKey(table.TableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read primary key of table %s: %w", table.TableName, err)
+	}
+	if err := checkPrimaryKey(table, pk); err != nil {
+		return nil, err
+	}
+
+	if c.primaryKeys == nil {
+		c.primaryKeys = make(map[string][]string)
+	}
+	c.primaryKeys[table.TableName] = pk
+	return pk, nil
+}
+
+// checkPrimaryKey checks the primary key found in the database against the configured one, if any
+func checkPrimaryKey(table models.TableConfig, pk []string) error {
+	if len(pk) == 0 {
+		return fmt.Errorf("table %s has no primary key", table.TableName)
+	}
+	if table.PrimaryKey == "" {
+		return nil
+	}
+
+	expected := splitColumns(table.PrimaryKey)
+	matches := len(expected) == len(pk)
+	for _, column := range expected {
+		found := false
+		for _, name := range pk {
+			found = found || name == column
+		}
+		matches = matches && found
+	}
+	if !matches {
+		return fmt.Errorf("configured primary key (%s) of table %s does not match its primary key (%s) in the database",
+			strings.Join(expected, ", "), table.TableName, strings.Join(pk, ", "))
+	}
 	return nil
 }
+
+// execer executes SQL statements, implemented by database.DB and database.Tx
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// keyCondition is a WHERE condition matching a chunk of primary key values
+type keyCondition struct {
+	sql  string
+	args []interface{}
+}
+
+// Default number of primary keys per condition, lower with the or form whose conditions
+// grow with every key, and maximum number of bind parameters of a statement (PostgreSQL)
+const (
+	defaultKeyChunkSize   = 500
+	defaultOrKeyChunkSize = 100
+	maxBindParameters     = 65535
+)
+
+// keyChunkSize returns the number of primary keys per condition for a key form
+func keyChunkSize(size int, form string) int {
+	if size > 0 {
+		return size
+	}
+	if form == models.KeyFormOr {
+		return defaultOrKeyChunkSize
+	}
+	return defaultKeyChunkSize
+}
+
+// keyConditions builds the conditions matching the given primary key values in chunks of
+// KeyChunkSize keys, fewer when the chunk would exceed the bind parameter limit
+func (c *Cleaner) keyConditions(quotedPK []string, keys [][]interface{}) []keyCondition {
+	chunkSize := keyChunkSize(c.config.KeyChunkSize, c.config.CompositeKeyForm)
+	if chunkSize*len(quotedPK) > maxBindParameters {
+		chunkSize = maxBindParameters / len(quotedPK)
+	}
+
+	var chunks []keyCondition
+	for start := 0; start < len(keys); start += chunkSize {
+		end := start + chunkSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		switch {
+		case len(quotedPK) == 1:
+			chunks = append(chunks, inKeyCondition(quotedPK[0], keys[start:end]))
+		case c.config.CompositeKeyForm == models.KeyFormOr:
+			chunks = append(chunks, orKeyCondition(quotedPK, keys[start:end]))
+		default:
+			chunks = append(chunks, c.rowInKeyCondition(quotedPK, keys[start:end]))
+		}
+	}
+	return chunks
+}
+
+// inKeyCondition matches single column key values, e.g. id IN (?, ?, ?)
+func inKeyCondition(quotedColumn string, keys [][]interface{}) keyCondition {
+	ids := make([]interface{}, len(keys))
+	for i, key := range keys {
+		ids[i] = key[0]
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", ")
+	return keyCondition{fmt.Sprintf("%s IN (%s)", quotedColumn, placeholders), ids}
+}
+
+// rowInKeyCondition matches composite key values with a row constructor,
+// e.g. (col1, col2, col3) IN ((?, ?, ?), (?, ?, ?))
+func (c *Cleaner) rowInKeyCondition(quotedPK []string, keys [][]interface{}) keyCondition {
+	row := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(quotedPK)), ", ") + ")"
+	rows := make([]string, len(keys))
+	args := make([]interface{}, 0, len(keys)*len(quotedPK))
+	for i, key := range keys {
+		rows[i] = row
+		args = append(args, key...)
+	}
+	return keyCondition{fmt.Sprintf("(%s) IN %s", strings.Join(quotedPK, ", "), c.db.RowList(rows)), args}
+}
+
+// orKeyCondition matches composite key values one by one,
+// e.g. (col1 = ? AND col2 = ? AND col3 = ?) OR (col1 = ? AND col2 = ? AND col3 = ?)
+func orKeyCondition(quotedPK []string, keys [][]interface{}) keyCondition {
+	var whereClauseParts []string
+	var allParams []interface{}
+	for _, key := range keys {
+		var conditions []string
+		for j, col := range quotedPK {
+			conditions = append(conditions, fmt.Sprintf("%s = ?", col))
+			allParams = append(allParams, key[j])
+		}
+		whereClauseParts = append(whereClauseParts, "("+strings.Join(conditions, " AND ")+")")
+	}
+	return keyCondition{strings.Join(whereClauseParts, " OR "), allParams}
+}
+
+// keysetCondition builds the condition matching the records whose primary key comes after
+// the given key, e.g. (dag_id, task_id, run_id, map_index) > (?, ?, ?, ?), expanded to
+// dag_id > ? OR (dag_id = ? AND task_id > ?) OR ... with the or composite key form
+func (c *Cleaner) keysetCondition(quotedPK []string, key []interface{}) (string, []interface{}) {
+	if len(quotedPK) == 1 {
+		return fmt.Sprintf("%s > ?", quotedPK[0]), key
+	}
+	if c.config.CompositeKeyForm != models.KeyFormOr {
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(quotedPK)), ", ")
+		return fmt.Sprintf("(%s) > (%s)", strings.Join(quotedPK, ", "), placeholders), key
+	}
+
+	var alternatives []string
+	var args []interface{}
+	for i, col := range quotedPK {
+		var conditions []string
+		for j := 0; j < i; j++ {
+			conditions = append(conditions, fmt.Sprintf("%s = ?", quotedPK[j]))
+			args = append(args, key[j])
+		}
+		conditions = append(conditions, fmt.Sprintf("%s > ?", col))
+		args = append(args, key[i])
+		alternatives = append(alternatives, "("+strings.Join(conditions, " AND ")+")")
+	}
+	return "(" + strings.Join(alternatives, " OR ") + ")", args
+}
+
+// cursorKey copies a primary key value for the keyset condition. Raw bytes are compared
+// as strings, so that they follow the collation of the ORDER BY rather than binary order.
+func cursorKey(key []interface{}) []interface{} {
+	cursor := make([]interface{}, len(key))
+	for i, value := range key {
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		cursor[i] = value
+	}
+	return cursor
+}
+
+// deleteByKeys deletes the records with the given primary key values, only those still
+// matching condition unless it is empty
+func (c *Cleaner) deleteByKeys(db execer, table string, quotedPK []string, keys [][]interface{}, condition string, args []interface{}) (int, error) {
+	var deleted int
+	for _, cond := range c.keyConditions(quotedPK, keys) {
+		where, whereArgs := recheckCondition(cond, condition, args)
+		deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE %s", c.db.Quote(table), where)
+
+		result, err := db.Exec(deleteSQL, whereArgs...)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete records: %w", err)
+		}
+
+		rowsAffected, _ := result.RowsAffected()
+		deleted += int(rowsAffected)
+	}
+	return deleted, nil
+}
+
+// recheckCondition adds a condition to a key condition, when not empty
+func recheckCondition(key keyCondition, condition string, args []interface{}) (string, []interface{}) {
+	if condition == "" {
+		return key.sql, key.args
+	}
+	return fmt.Sprintf("(%s) AND (%s)", key.sql, condition), append(append([]interface{}{}, key.args...), args...)
+}
+
+// recordBatch holds a batch of records selected for deletion
+type recordBatch struct {
+	columns []string
+	types   []*sql.ColumnType
+	rows    [][]interface{}
+	keys    [][]interface{} // Primary key values of each row
+}
+
+// values returns the values of the given columns of each row of the batch
+func (b *recordBatch) values(columns []string) ([][]interface{}, error) {
+	index := make([]int, len(columns))
+	for i, col := range columns {
+		index[i] = -1
+		for j, name := range b.columns {
+			if strings.EqualFold(name, col) {
+				index[i] = j
+				break
+			}
+		}
+		if index[i] < 0 {
+			return nil, fmt.Errorf("column %s not found in result", col)
+		}
+	}
+
+	values := make([][]interface{}, len(b.rows))
+	for i, row := range b.rows {
+		values[i] = make([]interface{}, len(index))
+		for k, j := range index {
+			values[i][k] = row[j]
+		}
+	}
+	return values, nil
+}
+
+// fetchBatch runs a batch selection query and extracts the primary key values of each row
+func (c *Cleaner) fetchBatch(query string, pk []string, args ...interface{}) (*recordBatch, error) {
+	rows, err := c.db.Queryx(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query primary keys: %w", err)
+	}
+	defer rows.Close()
+
+	batch := &recordBatch{}
+	if batch.columns, err = rows.Columns(); err != nil {
+		return nil, fmt.Errorf("failed to get columns: %w", err)
+	}
+	if batch.types, err = rows.ColumnTypes(); err != nil {
+		return nil, fmt.Errorf("failed to get column types: %w", err)
+	}
+
+	// Locate primary key columns in the result
+	pkIndex := make([]int, len(pk))
+	for i, col := range pk {
+		pkIndex[i] = -1
+		for j, name := range batch.columns {
+			if strings.EqualFold(name, col) {
+				pkIndex[i] = j
+				break
+			}
+		}
+		if pkIndex[i] < 0 {
+			return nil, fmt.Errorf("primary key column %s not found in result", col)
+		}
+	}
+
+	for rows.Next() {
+		row, err := rows.SliceScan()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan primary key: %w", err)
+		}
+
+		key := make([]interface{}, len(pkIndex))
+		for i, j := range pkIndex {
+			key[i] = row[j]
+		}
+		batch.rows = append(batch.rows, row)
+		batch.keys = append(batch.keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read primary keys: %w", err)
+	}
+
+	return batch, nil
+}
@@ -0,0 +1,513 @@
+package service
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// testSchema is a subset of the Airflow 2 schema, with the keys and cascading foreign keys
+// of the tables the cleaner relies on
+var testSchema = []string{
+	`CREATE TABLE dag_run (
+		id INTEGER NOT NULL PRIMARY KEY,
+		dag_id VARCHAR(250) NOT NULL,
+		execution_date TIMESTAMP NOT NULL,
+		state VARCHAR(50),
+		run_id VARCHAR(250) NOT NULL,
+		start_date TIMESTAMP,
+		end_date TIMESTAMP,
+		UNIQUE (dag_id, run_id)
+	)`,
+	`CREATE TABLE task_instance (
+		task_id VARCHAR(250) NOT NULL,
+		dag_id VARCHAR(250) NOT NULL,
+		run_id VARCHAR(250) NOT NULL,
+		map_index INTEGER DEFAULT -1 NOT NULL,
+		start_date TIMESTAMP,
+		end_date TIMESTAMP,
+		state VARCHAR(20),
+		queued_dttm TIMESTAMP,
+		updated_at TIMESTAMP,
+		PRIMARY KEY (dag_id, task_id, run_id, map_index),
+		FOREIGN KEY (dag_id, run_id) REFERENCES dag_run (dag_id, run_id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE xcom (
+		dag_run_id INTEGER NOT NULL,
+		task_id VARCHAR(250) NOT NULL,
+		map_index INTEGER DEFAULT -1 NOT NULL,
+		"key" VARCHAR(512) NOT NULL,
+		dag_id VARCHAR(250) NOT NULL,
+		run_id VARCHAR(250) NOT NULL,
+		value BLOB,
+		timestamp TIMESTAMP NOT NULL,
+		PRIMARY KEY (dag_run_id, task_id, map_index, "key"),
+		FOREIGN KEY (dag_id, task_id, run_id, map_index)
+			REFERENCES task_instance (dag_id, task_id, run_id, map_index) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE rendered_task_instance_fields (
+		dag_id VARCHAR(250) NOT NULL,
+		task_id VARCHAR(250) NOT NULL,
+		run_id VARCHAR(250) NOT NULL,
+		map_index INTEGER DEFAULT -1 NOT NULL,
+		rendered_fields TEXT NOT NULL,
+		k8s_pod_yaml TEXT,
+		PRIMARY KEY (dag_id, task_id, run_id, map_index),
+		FOREIGN KEY (dag_id, task_id, run_id, map_index)
+			REFERENCES task_instance (dag_id, task_id, run_id, map_index) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE dag_run_note (
+		user_id INTEGER,
+		dag_run_id INTEGER NOT NULL PRIMARY KEY,
+		content VARCHAR(1000),
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		FOREIGN KEY (dag_run_id) REFERENCES dag_run (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE log (
+		id INTEGER NOT NULL PRIMARY KEY,
+		dttm TIMESTAMP,
+		dag_id VARCHAR(250),
+		task_id VARCHAR(250),
+		event VARCHAR(30),
+		execution_date TIMESTAMP
+	)`,
+	`CREATE INDEX idx_log_dttm ON log (dttm)`,
+}
+
+// Test data: testRuns runs of each test DAG, one week apart from testRunAge days ago, with
+// a note, testTasks task instances each, an XCom and rendered fields per task instance and a
+// log record per run. Log ids are testLogIDGap apart, as in tables whose ids are sparse.
+const (
+	testRuns     = 10
+	testRunAge   = 3
+	testTasks    = 2
+	testLogIDGap = 1000000
+)
+
+var testDags = []string{"etl_daily", "report_hourly"}
+
+// newTestDB creates a SQLite database with the test schema in a temporary directory
+func newTestDB(t *testing.T) *database.DB {
+	t.Helper()
+	return openTestDB(t, testSchema)
+}
+
+// openTestDB creates a SQLite test database of the given schema
+func openTestDB(t *testing.T, schema []string) *database.DB {
+	t.Helper()
+	db, err := database.New(database.Config{Driver: "sqlite", Path: filepath.Join(t.TempDir(), "airflow.db")})
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	for _, statement := range schema {
+		mustExec(t, db, statement)
+	}
+	return db
+}
+
+// seedTestDB fills the test database. The last but one run of the last DAG is still
+// running, and the first task of the oldest run of the first DAG never started.
+func seedTestDB(t *testing.T, db *database.DB) {
+	t.Helper()
+	now := time.Now()
+	var id int
+	for d, dag := range testDags {
+		for i := 0; i < testRuns; i++ {
+			id++
+			date := now.AddDate(0, 0, -testRunAge-7*i)
+			runID := fmt.Sprintf("scheduled__%d", i)
+			state, taskState := "success", "success"
+			if d == len(testDags)-1 && i == testRuns-2 {
+				state, taskState = "running", "running"
+			}
+			mustExec(t, db, "INSERT INTO dag_run (id, dag_id, execution_date, state, run_id, start_date) VALUES (?, ?, ?, ?, ?, ?)",
+				id, dag, date, state, runID, date)
+			mustExec(t, db, "INSERT INTO dag_run_note (dag_run_id, content, created_at, updated_at) VALUES (?, ?, ?, ?)",
+				id, "checked", date, date)
+			mustExec(t, db, "INSERT INTO log (id, dttm, dag_id, event, execution_date) VALUES (?, ?, ?, ?, ?)",
+				id*testLogIDGap, date, dag, "success", date)
+
+			for task := 0; task < testTasks; task++ {
+				taskID := fmt.Sprintf("task_%d", task)
+				var start interface{} = date
+				if d == 0 && i == testRuns-1 && task == 0 {
+					start = nil
+				}
+				mustExec(t, db, "INSERT INTO task_instance (task_id, dag_id, run_id, start_date, state, queued_dttm) VALUES (?, ?, ?, ?, ?, ?)",
+					taskID, dag, runID, start, taskState, date)
+				mustExec(t, db, `INSERT INTO xcom (dag_run_id, task_id, "key", dag_id, run_id, value, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+					id, taskID, "return_value", dag, runID, []byte(`"ok"`), date)
+				mustExec(t, db, "INSERT INTO rendered_task_instance_fields (dag_id, task_id, run_id, rendered_fields) VALUES (?, ?, ?, ?)",
+					dag, taskID, runID, "{}")
+			}
+		}
+	}
+}
+
+// newTestCleaner creates a cleaner of the airflow2 preset tables with a 30 days retention,
+// deleting small batches without pause
+func newTestCleaner(t *testing.T, db *database.DB) *Cleaner {
+	t.Helper()
+	tables, err := resolveTables(PresetAirflow2, map[string]int{"dag_run": 30}, nil)
+	if err != nil {
+		t.Fatalf("failed to resolve tables: %v", err)
+	}
+	return NewCleaner(db, models.Config{
+		Tables:           tables,
+		BatchSize:        4,
+		CompositeKeyForm: models.KeyFormRowIn,
+		KeyChunkSize:     500,
+		Archive:          models.ArchiveConfig{Directory: t.TempDir(), Format: models.ArchiveFormatJSONL},
+	})
+}
+
+// testTable returns the configuration of a table of the cleaner
+func testTable(t *testing.T, c *Cleaner, name string) models.TableConfig {
+	t.Helper()
+	table, ok := c.tableConfig(name)
+	if !ok {
+		t.Fatalf("table %s is not configured", name)
+	}
+	return table
+}
+
+// mustExec executes a statement on the test database
+func mustExec(t *testing.T, db *database.DB, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := db.Exec(query, args...); err != nil {
+		t.Fatalf("failed to execute %s: %v", query, err)
+	}
+}
+
+// countRows counts the records of a table matching an optional condition
+func countRows(t *testing.T, db *database.DB, table, where string, args ...interface{}) int {
+	t.Helper()
+	query := "SELECT COUNT(*) FROM " + db.Quote(table)
+	if where != "" {
+		query += " WHERE " + where
+	}
+	var count int
+	if err := db.Get(&count, query, args...); err != nil {
+		t.Fatalf("failed to count records of table %s: %v", table, err)
+	}
+	return count
+}
+
+// checkCounts compares the number of records of each table with the expected one
+func checkCounts(t *testing.T, db *database.DB, expected map[string]int) {
+	t.Helper()
+	for table, count := range expected {
+		if actual := countRows(t, db, table, ""); actual != count {
+			t.Errorf("table %s has %d records, expected %d", table, actual, count)
+		}
+	}
+}
+
+// Of the 10 weekly runs of each DAG from 3 days ago, the 6 older than 30 days are expired,
+// except the running one: 11 expired runs, 22 expired task instances and 12 expired logs.
+func TestCleanTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		clean   func(*Cleaner, models.TableConfig) error
+		keyForm string
+	}{
+		{"delete limit", (*Cleaner).cleanTable, models.KeyFormRowIn},
+		{"primary key row_in", (*Cleaner).cleanTableByPK, models.KeyFormRowIn},
+		{"primary key or", (*Cleaner).cleanTableByPK, models.KeyFormOr},
+		{"date window", (*Cleaner).cleanTableByDateWindow, models.KeyFormRowIn},
+		{"pk range", cleanByPKRange, models.KeyFormRowIn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := newTestDB(t)
+			seedTestDB(t, db)
+			c := newTestCleaner(t, db)
+			c.config.CompositeKeyForm = tt.keyForm
+
+			// Task instances take their XComs with them, the never started one is dated
+			// by queued_dttm and the running ones are kept
+			for _, name := range []string{"task_instance", "log"} {
+				if err := tt.clean(c, testTable(t, c, name)); err != nil {
+					t.Fatalf("failed to clean table %s: %v", name, err)
+				}
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 20, "task_instance": 18, "xcom": 18, "log": 8})
+			if n := countRows(t, db, "task_instance", "state = ?", "running"); n != testTasks {
+				t.Errorf("%d running task instances left, expected %d", n, testTasks)
+			}
+
+			if err := tt.clean(c, testTable(t, c, "dag_run")); err != nil {
+				t.Fatalf("failed to clean table dag_run: %v", err)
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 9, "task_instance": 18, "xcom": 18, "log": 8})
+		})
+	}
+}
+
+// cleanByPKRange cleans the tables with a single column primary key by primary key ranges,
+// the others by primary key
+func cleanByPKRange(c *Cleaner, table models.TableConfig) error {
+	pk, err := c.primaryKey(table)
+	if err != nil {
+		return err
+	}
+	if len(pk) != 1 {
+		return c.cleanTableByPK(table)
+	}
+	return c.cleanTableByPKRange(table)
+}
+
+func TestCleanTableDryRun(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+	c.config.DryRun = true
+
+	for _, name := range []string{"dag_run", "task_instance", "log"} {
+		if err := c.cleanTableByPK(testTable(t, c, name)); err != nil {
+			t.Fatalf("failed to clean table %s: %v", name, err)
+		}
+	}
+	checkCounts(t, db, map[string]int{"dag_run": 20, "task_instance": 40, "xcom": 40, "log": 20})
+}
+
+// In dry run mode, the XComs of the expired task instances are expired themselves and
+// counted for table xcom rather than as deleted by cascade
+func TestPlanTable(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+
+	for _, dryRun := range []bool{false, true} {
+		plan, err := c.planTable(testTable(t, c, "task_instance"), dryRun)
+		if err != nil {
+			t.Fatalf("failed to plan table task_instance: %v", err)
+		}
+		if plan.Count != 22 || plan.FallbackCount != 1 {
+			t.Errorf("planned %d records with %d dated by fallback, expected 22 with 1", plan.Count, plan.FallbackCount)
+		}
+		cascaded := 22
+		if dryRun {
+			cascaded = 0
+		}
+		counts := make(map[string]int)
+		for _, cascade := range plan.Cascades {
+			counts[cascade.Table] = cascade.Count
+		}
+		if len(counts) != 2 || counts["xcom"] != cascaded || counts["rendered_task_instance_fields"] != cascaded {
+			t.Errorf("planned cascades %+v in dry run %v, expected %d records of tables xcom and rendered_task_instance_fields",
+				plan.Cascades, dryRun, cascaded)
+		}
+	}
+}
+
+// Fallback date columns are only compared for records without date, leaving the date
+// column alone on its side of the OR for its index
+func TestDateCondition(t *testing.T) {
+	db := newTestDB(t)
+	c := newTestCleaner(t, db)
+	start := time.Now().AddDate(0, 0, -2)
+	end := time.Now().AddDate(0, 0, -1)
+	ti := models.TableConfig{TableName: "task_instance", DateColumn: "start_date"}
+
+	tests := []struct {
+		table    models.TableConfig
+		columns  []string
+		start    time.Time
+		expected string
+		args     int
+	}{
+		{ti, []string{"start_date"}, time.Time{}, `"start_date" < ?`, 1},
+		{ti, []string{"start_date", "queued_dttm"}, time.Time{},
+			`("start_date" < ? OR ("start_date" IS NULL AND "queued_dttm" < ?))`, 2},
+		{ti, []string{"start_date", "queued_dttm", "updated_at"}, start,
+			`("start_date" >= ? AND "start_date" < ? OR ("start_date" IS NULL AND COALESCE("queued_dttm", "updated_at") >= ? AND COALESCE("queued_dttm", "updated_at") < ?))`, 4},
+		{testTable(t, c, "rendered_task_instance_fields"), []string{"execution_date"}, time.Time{},
+			`EXISTS (SELECT 1 FROM "dag_run" WHERE "dag_run"."dag_id" = "rendered_task_instance_fields"."dag_id" AND ` +
+				`"dag_run"."run_id" = "rendered_task_instance_fields"."run_id" AND "dag_run"."execution_date" < ?)`, 1},
+	}
+	for _, tt := range tests {
+		condition, args := c.dateCondition(tt.table, tt.columns, tt.start, end)
+		if condition != tt.expected || len(args) != tt.args {
+			t.Errorf("date condition %s with %d arguments, expected %s with %d", condition, len(args), tt.expected, tt.args)
+		}
+	}
+}
+
+// Keys are chunked whatever the number of key columns, within the bind parameter limit
+func TestKeyConditions(t *testing.T) {
+	c := newTestCleaner(t, newTestDB(t))
+	keys := func(n, columns int) [][]interface{} {
+		keys := make([][]interface{}, n)
+		for i := range keys {
+			keys[i] = make([]interface{}, columns)
+		}
+		return keys
+	}
+	ti := []string{`"dag_id"`, `"task_id"`, `"run_id"`, `"map_index"`}
+
+	tests := []struct {
+		form      string
+		chunkSize int
+		quotedPK  []string
+		keys      int
+		chunks    int
+		expected  string // Condition of the last chunk
+	}{
+		{models.KeyFormRowIn, 2, []string{`"id"`}, 5, 3, `"id" IN (?)`},
+		{models.KeyFormRowIn, 0, []string{`"id"`}, 70000, 140, ""},
+		{models.KeyFormOr, 0, ti[:2], 250, 3, ""},
+		{models.KeyFormRowIn, 20000, ti, 20000, 2, ""},
+		{models.KeyFormOr, 2, ti[:2], 3, 2, `("dag_id" = ? AND "task_id" = ?)`},
+	}
+	for _, tt := range tests {
+		c.config.CompositeKeyForm = tt.form
+		c.config.KeyChunkSize = tt.chunkSize
+		chunks := c.keyConditions(tt.quotedPK, keys(tt.keys, len(tt.quotedPK)))
+		if len(chunks) != tt.chunks {
+			t.Errorf("%d %s keys of %d columns in %d chunks, expected %d", tt.keys, tt.form, len(tt.quotedPK), len(chunks), tt.chunks)
+			continue
+		}
+		for _, chunk := range chunks {
+			if len(chunk.args) > maxBindParameters {
+				t.Errorf("chunk of %d bind parameters, expected at most %d", len(chunk.args), maxBindParameters)
+			}
+		}
+		if last := chunks[len(chunks)-1]; tt.expected != "" && last.sql != tt.expected {
+			t.Errorf("last chunk %s, expected %s", last.sql, tt.expected)
+		}
+	}
+}
+
+// A configured primary key must match the one of the database, in any order, and tables
+// without primary key cannot be deleted by key
+func TestPrimaryKey(t *testing.T) {
+	db := newTestDB(t)
+	mustExec(t, db, "CREATE TABLE event_log (dttm TIMESTAMP, event VARCHAR(30))")
+
+	tests := []struct {
+		table      string
+		primaryKey string
+		expected   string // Primary key found, empty when it is rejected
+	}{
+		{"log", "", "[id]"},
+		{"log", "id", "[id]"},
+		{"task_instance", "run_id, dag_id, map_index, task_id", "[dag_id task_id run_id map_index]"},
+		{"task_instance", "dag_id, task_id, run_id", ""},
+		{"log", "dttm", ""},
+		{"event_log", "", ""},
+		{"event_log", "dttm", ""},
+	}
+	for _, tt := range tests {
+		c := newTestCleaner(t, db)
+		pk, err := c.primaryKey(models.TableConfig{TableName: tt.table, PrimaryKey: tt.primaryKey})
+		if tt.expected == "" {
+			if err == nil {
+				t.Errorf("primary key %v of table %s configured as %q, expected an error", pk, tt.table, tt.primaryKey)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("failed to read primary key of table %s configured as %q: %v", tt.table, tt.primaryKey, err)
+			continue
+		}
+		if fmt.Sprint(pk) != tt.expected {
+			t.Errorf("primary key %v of table %s configured as %q, expected %s", pk, tt.table, tt.primaryKey, tt.expected)
+		}
+	}
+}
+
+func TestDeletionMethod(t *testing.T) {
+	tests := []struct {
+		strategy string
+		usePK    bool
+		archive  string
+		expected string
+	}{
+		{models.StrategyDefault, false, "", MethodDeleteLimit},
+		{models.StrategyDefault, true, "", MethodPrimaryKey},
+		{models.StrategyDefault, false, models.ArchiveModeFile, MethodPrimaryKey},
+		{models.StrategyPKRange, false, models.ArchiveModeTable, models.StrategyPKRange},
+		{models.StrategyCopySwap, true, "", models.StrategyCopySwap},
+	}
+	for _, tt := range tests {
+		c := NewCleaner(nil, models.Config{UsePrimaryKeyDelete: tt.usePK, Archive: models.ArchiveConfig{Mode: tt.archive}})
+		if method := c.DeletionMethod(models.TableConfig{TableName: "log", Strategy: tt.strategy}); method != tt.expected {
+			t.Errorf("strategy %q with primary key deletes %v and archive mode %q deletes by %s, expected %s",
+				tt.strategy, tt.usePK, tt.archive, method, tt.expected)
+		}
+	}
+}
+
+// The 6 latest runs of each DAG are kept, ranked by their date with its fallback when the
+// runs of a DAG have no start date: 4 expired runs of the first DAG and 3 of the last one,
+// as its running run is kept too
+func TestKeepLastRuns(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	mustExec(t, db, "UPDATE dag_run SET start_date = NULL WHERE dag_id = ?", testDags[0])
+	c := newTestCleaner(t, db)
+	c.config.KeepLastRunsPerDag = 6
+	for i := range c.config.Tables {
+		if c.config.Tables[i].TableName == "dag_run" {
+			c.config.Tables[i].DateColumn = "start_date"
+			c.config.Tables[i].FallbackDateColumns = []string{"execution_date"}
+		}
+	}
+
+	if err := c.cleanTableByPK(testTable(t, c, "dag_run")); err != nil {
+		t.Fatalf("failed to clean table dag_run: %v", err)
+	}
+	checkCounts(t, db, map[string]int{"dag_run": 13, "task_instance": 26})
+	for _, dag := range testDags {
+		if n := countRows(t, db, "dag_run", "dag_id = ? AND run_id IN ('scheduled__4', 'scheduled__5')", dag); n != 2 {
+			t.Errorf("%d of the 5th and 6th runs of DAG %s kept, expected 2", n, dag)
+		}
+	}
+}
+
+// dag_id patterns are case-sensitive, also on SQLite whose LIKE is not
+func TestDagOverrides(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+	for i := range c.config.Tables {
+		if c.config.Tables[i].TableName == "dag_run" {
+			c.config.Tables[i].DagOverrides = []models.DagOverride{{DagPattern: "ETL_*", RetentionDays: 1}, {DagPattern: "etl_*", RetentionDays: 60}}
+		}
+	}
+
+	plan, err := c.planTable(testTable(t, c, "dag_run"), true)
+	if err != nil {
+		t.Fatalf("failed to plan table dag_run: %v", err)
+	}
+	counts := make([]int, len(plan.Scopes))
+	for i, scope := range plan.Scopes {
+		counts[i] = scope.Count
+	}
+	if fmt.Sprint(counts) != "[0 1 5]" {
+		t.Errorf("planned %v records per scope, expected [0 1 5]", counts)
+	}
+}
+
+// Rendered fields are dated by their run and kept with the running one
+func TestCleanRunDatedTable(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+
+	if err := c.cleanTableByPK(testTable(t, c, "rendered_task_instance_fields")); err != nil {
+		t.Fatalf("failed to clean table rendered_task_instance_fields: %v", err)
+	}
+	checkCounts(t, db, map[string]int{"rendered_task_instance_fields": 18, "task_instance": 40})
+	if n := countRows(t, db, "rendered_task_instance_fields", "run_id = ?", fmt.Sprintf("scheduled__%d", testRuns-2)); n != testTasks {
+		t.Errorf("%d rendered fields of the running run left, expected %d", n, testTasks)
+	}
+}
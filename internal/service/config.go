@@ -2,6 +2,7 @@ package service
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"time"
 
@@ -13,11 +14,15 @@ import (
 // AppConfig stores application configuration
 type AppConfig struct {
 	Database struct {
+		Driver          string        `yaml:"driver"`
 		Host            string        `yaml:"host"`
 		Port            int           `yaml:"port"`
 		User            string        `yaml:"user"`
 		Password        string        `yaml:"password"`
 		Name            string        `yaml:"name"`
+		Schema          string        `yaml:"schema"`
+		SSLMode         string        `yaml:"sslmode"`
+		Path            string        `yaml:"path"`
 		MaxIdleConns    int           `yaml:"max_idle_conns"`
 		MaxOpenConns    int           `yaml:"max_open_conns"`
 		ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime"`
@@ -25,25 +30,50 @@ type AppConfig struct {
 	} `yaml:"database"`
 
 	Cleaner struct {
-		RetentionDays struct {
-			DagRun       int `yaml:"dag_run"`
-			TaskInstance int `yaml:"task_instance"`
-			XCom         int `yaml:"xcom"`
-			Log          int `yaml:"log"`
-			Job          int `yaml:"job"`
-		} `yaml:"retention_days"`
+		// Retention days per table name, used by preset tables
+		RetentionDays map[string]int `yaml:"retention_days"`
+		// Built-in table preset, "auto" to choose it from the schema of the database,
+		// "none" to clean only the tables listed below
+		Preset string `yaml:"preset"`
+		// Table definitions, overriding or extending the preset
+		Tables []TableDefinition `yaml:"tables"`
+		// Retention per table for the DAGs matching dag_id patterns, first match wins
+		DagOverrides []DagOverrideDefinition `yaml:"dag_overrides"`
+
 		BatchSize           int           `yaml:"batch_size"`
 		SleepBetweenBatches time.Duration `yaml:"sleep_between_batches"`
 		SleepSeconds        float64       `yaml:"sleep_seconds"`
 		DryRun              bool          `yaml:"dry_run"`
 		Verbose             bool          `yaml:"verbose"`
 		UsePrimaryKeyDelete bool          `yaml:"use_primary_key_delete"`
+		// Composite primary keys are matched with row_in, (a, b) IN ((?, ?), ...), or or,
+		// (a = ? AND b = ?) OR ..., key_chunk_size keys per statement (500, 100 with or)
+		CompositeKeyForm string `yaml:"composite_key_form"`
+		KeyChunkSize     int    `yaml:"key_chunk_size"`
+		// Number of most recent runs of each DAG never cleaned, 0 to disable
+		KeepLastRunsPerDag int `yaml:"keep_last_runs_per_dag"`
+		// Running jobs whose heartbeat is older than heartbeat_timeout are failed or deleted
+		ZombieJobs struct {
+			HeartbeatTimeout time.Duration `yaml:"heartbeat_timeout"`
+			Action           string        `yaml:"action"`
+		} `yaml:"zombie_jobs"`
+
+		Archive struct {
+			Mode      string `yaml:"mode"`
+			Directory string `yaml:"directory"`
+			Format    string `yaml:"format"`
+		} `yaml:"archive"`
 	} `yaml:"cleaner"`
 
 	Log struct {
 		Level string `yaml:"level"`
 		File  string `yaml:"file"`
 	} `yaml:"log"`
+
+	// Resolved table configurations, nil until the preset is known
+	tables []models.TableConfig
+	// Tables selected on the command line, nil for the enabled tables
+	selected []string
 }
 
 // LoadConfig loads configuration from file
@@ -65,18 +95,163 @@ func LoadConfig(configPath string) (*AppConfig, error) {
 	if config.Cleaner.SleepSeconds <= 0 {
 		config.Cleaner.SleepSeconds = 5.0
 	}
+	if config.Cleaner.Archive.Directory == "" {
+		config.Cleaner.Archive.Directory = "archive"
+	}
+	if config.Cleaner.Archive.Format == "" {
+		config.Cleaner.Archive.Format = models.ArchiveFormatJSONL
+	}
+	switch config.Cleaner.Archive.Mode {
+	case "", models.ArchiveModeFile, models.ArchiveModeTable:
+	default:
+		return nil, fmt.Errorf("unsupported archive mode %q", config.Cleaner.Archive.Mode)
+	}
+	switch config.Cleaner.Archive.Format {
+	case models.ArchiveFormatJSONL, models.ArchiveFormatCSV:
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q", config.Cleaner.Archive.Format)
+	}
+	if config.Cleaner.CompositeKeyForm == "" {
+		config.Cleaner.CompositeKeyForm = models.KeyFormRowIn
+	}
+	switch config.Cleaner.CompositeKeyForm {
+	case models.KeyFormRowIn, models.KeyFormOr:
+	default:
+		return nil, fmt.Errorf("unsupported composite key form %q", config.Cleaner.CompositeKeyForm)
+	}
+	config.Cleaner.KeyChunkSize = keyChunkSize(config.Cleaner.KeyChunkSize, config.Cleaner.CompositeKeyForm)
+	if config.Cleaner.KeepLastRunsPerDag < 0 {
+		return nil, fmt.Errorf("keep_last_runs_per_dag must not be negative")
+	}
+	if config.Cleaner.ZombieJobs.Action == "" {
+		config.Cleaner.ZombieJobs.Action = models.ZombieActionFail
+	}
+	switch config.Cleaner.ZombieJobs.Action {
+	case models.ZombieActionFail, models.ZombieActionDelete:
+	default:
+		return nil, fmt.Errorf("unsupported zombie job action %q", config.Cleaner.ZombieJobs.Action)
+	}
+	if timeout := config.Cleaner.ZombieJobs.HeartbeatTimeout; timeout != 0 && timeout < minZombieHeartbeatTimeout {
+		return nil, fmt.Errorf("zombie job heartbeat_timeout must be at least %s", minZombieHeartbeatTimeout)
+	}
+	if config.Cleaner.Preset == "" {
+		config.Cleaner.Preset = PresetAuto
+	}
+
+	// Resolve the tables to clean, the automatic preset once the schema is detected
+	if config.Cleaner.Preset != PresetAuto {
+		if err := config.resolveTables(config.Cleaner.Preset); err != nil {
+			return nil, err
+		}
+	}
 
 	return &config, nil
 }
 
+// resolveTables resolves the tables to clean from a preset and the table definitions
+func (c *AppConfig) resolveTables(preset string) error {
+	tables, err := resolveTables(preset, c.Cleaner.RetentionDays, c.Cleaner.Tables)
+	if err != nil {
+		return fmt.Errorf("invalid table configuration: %w", err)
+	}
+	if err := applyDagOverrides(tables, c.Cleaner.DagOverrides); err != nil {
+		return fmt.Errorf("invalid dag overrides: %w", err)
+	}
+	if err := c.checkStrategies(tables); err != nil {
+		return fmt.Errorf("invalid table configuration: %w", err)
+	}
+	c.tables = tables
+
+	if c.selected != nil {
+		return c.selectTables(c.selected)
+	}
+	return nil
+}
+
+// checkStrategies checks that the database and the archive mode support the strategies of the enabled tables
+func (c *AppConfig) checkStrategies(tables []models.TableConfig) error {
+	dialect, err := database.GetDialect(c.Database.Driver)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables {
+		if !table.Enabled || table.Strategy != models.StrategyCopySwap {
+			continue
+		}
+		if _, ok := dialect.(database.TableSwapper); !ok {
+			return fmt.Errorf("strategy %s of table %s is not supported on %s", table.Strategy, table.TableName, dialect.Name())
+		}
+		if c.Cleaner.Archive.Mode == models.ArchiveModeFile {
+			return fmt.Errorf("strategy %s of table %s cannot archive to files, only to tables", table.Strategy, table.TableName)
+		}
+	}
+	return nil
+}
+
+// UseSchema resolves the tables of the automatic preset from the detected schema,
+// and warns when the configured preset does not match it
+func (c *AppConfig) UseSchema(version *SchemaVersion) error {
+	switch c.Cleaner.Preset {
+	case PresetAuto:
+		log.Printf("Using the %s preset for %s", version.Preset, version)
+		c.Cleaner.Preset = version.Preset
+		return c.resolveTables(version.Preset)
+	case PresetNone, version.Preset:
+	default:
+		log.Printf("Warning: The %s preset is configured but the database schema is %s, matching the %s preset",
+			c.Cleaner.Preset, version, version.Preset)
+	}
+	return nil
+}
+
+// SelectTables restricts cleaning to the given tables, which must be configured.
+// With the automatic preset the selection applies once the tables are resolved.
+func (c *AppConfig) SelectTables(names []string) error {
+	c.selected = names
+	if c.tables == nil {
+		return nil
+	}
+	return c.selectTables(names)
+}
+
+// selectTables enables the given tables only
+func (c *AppConfig) selectTables(names []string) error {
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		selected[name] = true
+	}
+
+	for i := range c.tables {
+		table := &c.tables[i]
+		if selected[table.TableName] {
+			if table.RetentionDays <= 0 {
+				return fmt.Errorf("retention days for table %s must be greater than 0", table.TableName)
+			}
+			table.Enabled = true
+			delete(selected, table.TableName)
+		} else {
+			table.Enabled = false
+		}
+	}
+
+	for name := range selected {
+		return fmt.Errorf("table %s is not configured", name)
+	}
+	return nil
+}
+
 // GetDatabaseConfig extracts database configuration
 func (c *AppConfig) GetDatabaseConfig() database.Config {
 	return database.Config{
+		Driver:          c.Database.Driver,
 		Host:            c.Database.Host,
 		Port:            c.Database.Port,
 		User:            c.Database.User,
 		Password:        c.Database.Password,
 		Name:            c.Database.Name,
+		Schema:          c.Database.Schema,
+		SSLMode:         c.Database.SSLMode,
+		Path:            c.Database.Path,
 		MaxIdleConns:    c.Database.MaxIdleConns,
 		MaxOpenConns:    c.Database.MaxOpenConns,
 		ConnMaxLifetime: c.Database.ConnMaxLifetime,
@@ -87,17 +262,23 @@ func (c *AppConfig) GetDatabaseConfig() database.Config {
 // GetCleanerConfig extracts cleaner configuration
 func (c *AppConfig) GetCleanerConfig() models.Config {
 	return models.Config{
-		RetentionDays: map[string]int{
-			"dag_run":       c.Cleaner.RetentionDays.DagRun,
-			"task_instance": c.Cleaner.RetentionDays.TaskInstance,
-			"xcom":          c.Cleaner.RetentionDays.XCom,
-			"log":           c.Cleaner.RetentionDays.Log,
-			"job":           c.Cleaner.RetentionDays.Job,
-		},
+		Tables:              c.tables,
 		BatchSize:           c.Cleaner.BatchSize,
 		DryRun:              c.Cleaner.DryRun,
 		Verbose:             c.Cleaner.Verbose,
 		SleepSeconds:        c.Cleaner.SleepSeconds,
 		UsePrimaryKeyDelete: c.Cleaner.UsePrimaryKeyDelete,
+		CompositeKeyForm:    c.Cleaner.CompositeKeyForm,
+		KeyChunkSize:        c.Cleaner.KeyChunkSize,
+		KeepLastRunsPerDag:  c.Cleaner.KeepLastRunsPerDag,
+		ZombieJobs: models.ZombieJobPolicy{
+			HeartbeatTimeout: c.Cleaner.ZombieJobs.HeartbeatTimeout,
+			Action:           c.Cleaner.ZombieJobs.Action,
+		},
+		Archive: models.ArchiveConfig{
+			Mode:      c.Cleaner.Archive.Mode,
+			Directory: c.Cleaner.Archive.Directory,
+			Format:    c.Cleaner.Archive.Format,
+		},
 	}
 }
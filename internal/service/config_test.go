@@ -0,0 +1,38 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// copy_swap is refused when the configuration is loaded rather than when the table is cleaned
+func TestLoadConfigCopySwap(t *testing.T) {
+	tests := []struct {
+		driver  string
+		archive string
+		err     string
+	}{
+		{"sqlite", "", ""},
+		{"mysql", "table", ""},
+		{"postgres", "", "not supported on postgres"},
+		{"sqlite", "file", "cannot archive to files"},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		config := "database:\n  driver: " + tt.driver + "\ncleaner:\n  preset: airflow2\n  retention_days:\n    dag_run: 30\n" +
+			"  archive:\n    mode: \"" + tt.archive + "\"\n  tables:\n    - name: log\n      strategy: copy_swap\n"
+		if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+			t.Fatalf("failed to write configuration: %v", err)
+		}
+
+		_, err := LoadConfig(path)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("failed to load configuration on %s with archive mode %q: %v", tt.driver, tt.archive, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("loaded configuration on %s with archive mode %q with error %v, expected %q", tt.driver, tt.archive, err, tt.err)
+		}
+	}
+}
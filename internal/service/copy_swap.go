@@ -0,0 +1,292 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// Prefixes of the shadow table a table is copied to and of the swapped out table
+const (
+	shadowTablePrefix  = "_airflow_swap__"
+	swappedTablePrefix = "_airflow_swapped__"
+)
+
+// swapTableName returns the name of a table prefixed with prefix, truncated so that the
+// names of its mirror triggers fit the identifier length limit too
+func swapTableName(prefix, table string) string {
+	if maxLen := maxIdentifierLength - len(prefix) - len("_ins"); len(table) > maxLen {
+		table = table[:maxLen]
+	}
+	return prefix + table
+}
+
+// cleanTableByCopySwap cleans a table mostly made of expired records by copying the records
+// to keep to a shadow table, kept up to date by triggers during the copy, and renaming the
+// shadow table to the name of the table. The previous table is dropped, or kept with its
+// expired records only as archive table when archiving to tables.
+func (c *Cleaner) cleanTableByCopySwap(table models.TableConfig) error {
+	log.Printf("Cleaning table %s by copying the records to keep to a new table", table.TableName)
+	plan, err := c.planTable(table, c.config.DryRun)
+	if err != nil {
+		return err
+	}
+	if plan.Skipped != "" {
+		return nil
+	}
+
+	swapper, ok := c.db.Swapper()
+	if !ok {
+		return fmt.Errorf("strategy %s is not supported on %s", models.StrategyCopySwap, c.db.Dialect().Name())
+	}
+	if c.config.Archive.Mode == models.ArchiveModeFile {
+		return fmt.Errorf("strategy %s cannot archive to files, only to tables", models.StrategyCopySwap)
+	}
+	if err := c.checkSwappable(table.TableName); err != nil {
+		return err
+	}
+	pk, err := c.primaryKey(table)
+	if err != nil {
+		return err
+	}
+	if len(pk) == 0 {
+		return fmt.Errorf("strategy %s needs a primary key, table %s has none", models.StrategyCopySwap, table.TableName)
+	}
+
+	var total int
+	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s", c.db.Quote(table.TableName))
+	if err := c.db.Get(&total, countQuery); err != nil {
+		return fmt.Errorf("failed to count records: %w", err)
+	}
+	log.Printf("Will copy %d of the %d records of table %s to keep", total-plan.Count, total, table.TableName)
+
+	// If in dry run mode, stop here
+	if c.config.DryRun {
+		log.Printf("Dry run mode: No actual deletion operations will be performed")
+		return nil
+	}
+	if plan.Count == 0 {
+		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
+		return nil
+	}
+
+	return c.copySwap(swapper, table, plan, pk)
+}
+
+// checkSwappable refuses tables involved in foreign keys: the references to the table would
+// follow the swapped out table, and the shadow table is not created with foreign keys
+func (c *Cleaner) checkSwappable(name string) error {
+	foreignKeys, err := c.db.ForeignKeys()
+	if err != nil {
+		return fmt.Errorf("failed to read foreign keys: %w", err)
+	}
+	for _, fk := range foreignKeys {
+		if fk.ReferencedTable == name {
+			return fmt.Errorf("strategy %s cannot clean table %s, foreign key %s of table %s references it",
+				models.StrategyCopySwap, name, fk.Name, fk.Table)
+		}
+		if fk.Table == name {
+			return fmt.Errorf("strategy %s cannot clean table %s, its foreign key %s references table %s",
+				models.StrategyCopySwap, name, fk.Name, fk.ReferencedTable)
+		}
+	}
+	return nil
+}
+
+// copySwap copies the records of table that are not expired to a shadow table in batches of
+// primary keys, then swaps the tables
+func (c *Cleaner) copySwap(swapper database.TableSwapper, table models.TableConfig, plan *TablePlan, pk []string) (err error) {
+	shadow := swapTableName(shadowTablePrefix, table.TableName)
+	old := swapTableName(swappedTablePrefix, table.TableName)
+	if c.config.Archive.Mode == models.ArchiveModeTable {
+		old = archiveTableName(table.TableName, c.startAt)
+	}
+	exists, err := c.db.TableExists(old)
+	if err != nil {
+		return fmt.Errorf("failed to check if table exists: %w", err)
+	}
+	if exists {
+		return fmt.Errorf("table %s already exists, drop it before swapping table %s", old, table.TableName)
+	}
+
+	columns, err := c.db.Columns(table.TableName)
+	if err != nil {
+		return fmt.Errorf("failed to read columns of table %s: %w", table.TableName, err)
+	}
+	names := make([]string, len(columns))
+	quotedColumns := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+		quotedColumns[i] = c.db.Quote(column.Name)
+	}
+	quotedPK := make([]string, len(pk))
+	for i, column := range pk {
+		quotedPK[i] = c.db.Quote(column)
+	}
+	definitions, err := c.db.Definitions(swapper, table.TableName)
+	if err != nil {
+		return err
+	}
+
+	// A shadow table left by an interrupted run is dropped with its triggers
+	if err := c.dropShadow(swapper, shadow); err != nil {
+		return err
+	}
+	createSQL, err := swapper.ShadowTableSQL(table.TableName, shadow, definitions)
+	if err != nil {
+		return err
+	}
+	if _, err := c.db.Exec(createSQL); err != nil {
+		return fmt.Errorf("failed to create shadow table %s: %w", shadow, err)
+	}
+	defer func() {
+		if err != nil {
+			if dropErr := c.dropShadow(swapper, shadow); dropErr != nil {
+				log.Printf("Warning: Failed to drop shadow table %s: %v", shadow, dropErr)
+			}
+		}
+	}()
+
+	// Records written to the table during the copy are applied to the shadow table by triggers
+	for _, triggerSQL := range swapper.MirrorTriggersSQL(table.TableName, shadow, names, pk) {
+		if _, err := c.db.Exec(triggerSQL); err != nil {
+			return fmt.Errorf("failed to create trigger on table %s: %w", table.TableName, err)
+		}
+	}
+	log.Printf("Copying the records to keep of table %s to table %s", table.TableName, shadow)
+
+	// Batches are ranges of primary keys of the table holding BatchSize records that are
+	// not expired, which are copied
+	expired, args := combineScopes(plan.Scopes)
+	keep := fmt.Sprintf("CASE WHEN %s THEN 1 ELSE 0 END = 0", expired)
+	orderBy := strings.Join(quotedPK, ", ")
+	quotedTable := c.db.Quote(table.TableName)
+	sleepDuration := time.Duration(c.config.SleepSeconds * float64(time.Second))
+	var copied, batches int
+	var lastKey []interface{}
+	for {
+		startTime := time.Now()
+
+		// Last primary key of the batch, none for the last batch
+		where, whereArgs := "1 = 1", []interface{}{}
+		if lastKey != nil {
+			where, whereArgs = c.keysetCondition(quotedPK, lastKey)
+		}
+		where += " AND " + keep
+		whereArgs = append(whereArgs, args...)
+		boundQuery := fmt.Sprintf("SELECT %s FROM %s WHERE %s ORDER BY %s LIMIT 1 OFFSET %d",
+			orderBy, quotedTable, where, orderBy, c.config.BatchSize-1)
+		bound, err := c.fetchBatch(boundQuery, pk, whereArgs...)
+		if err != nil {
+			return err
+		}
+
+		copyWhere := where
+		copyArgs := append([]interface{}{}, whereArgs...)
+		if len(bound.keys) > 0 {
+			before, beforeArgs := c.keysetCondition(quotedPK, cursorKey(bound.keys[0]))
+			copyWhere += fmt.Sprintf(" AND NOT (%s)", before)
+			copyArgs = append(copyArgs, beforeArgs...)
+		}
+
+		selectSQL := fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+			strings.Join(quotedColumns, ", "), quotedTable, copyWhere)
+		result, err := c.db.Exec(swapper.InsertIgnoreSQL(shadow, names, selectSQL), copyArgs...)
+		if err != nil {
+			return fmt.Errorf("failed to copy records to table %s: %w", shadow, err)
+		}
+		rowsAffected, _ := result.RowsAffected()
+		copied += int(rowsAffected)
+		batches++
+		log.Printf("Copied %d records of table %s to keep after %d batches (batch time: %.2fs)",
+			copied, table.TableName, batches, time.Since(startTime).Seconds())
+
+		if len(bound.keys) == 0 {
+			break // The last batch reached the end of the table
+		}
+		lastKey = cursorKey(bound.keys[0])
+		if rowsAffected > 0 {
+			time.Sleep(sleepDuration)
+		}
+	}
+
+	// The triggers are dropped before the tables are renamed, so that a failed swap cannot
+	// leave them on the swapped out table. On MySQL, DROP TRIGGER and RENAME TABLE each commit
+	// on their own: the records to keep inserted in between are copied from the swapped out
+	// table once renamed, aliased to the name of the table the conditions of the scopes refer
+	// to. On SQLite, the swap is one transaction. The triggers copied the expired records
+	// inserted or updated during the copy too; they are deleted once the shadow table has the
+	// name of the table.
+	quotedOld := c.db.Quote(old)
+	var missed, leftover int
+	err = c.db.Transaction(func(tx *database.Tx) error {
+		for _, dropSQL := range swapper.DropMirrorTriggersSQL(shadow) {
+			if _, err := tx.Exec(dropSQL); err != nil {
+				return fmt.Errorf("failed to drop trigger: %w", err)
+			}
+		}
+		for _, swapSQL := range swapper.SwapSQL(table.TableName, shadow, old, definitions) {
+			if _, err := tx.Exec(swapSQL); err != nil {
+				return fmt.Errorf("failed to swap table %s: %w", table.TableName, err)
+			}
+		}
+		selectSQL := fmt.Sprintf("SELECT %s FROM %s %s WHERE %s",
+			strings.Join(quotedColumns, ", "), quotedOld, quotedTable, keep)
+		result, err := tx.Exec(swapper.InsertIgnoreSQL(table.TableName, names, selectSQL), args...)
+		if err != nil {
+			return fmt.Errorf("failed to copy the records to keep written during the swap of table %s: %w", table.TableName, err)
+		}
+		rowsAffected, _ := result.RowsAffected()
+		missed = int(rowsAffected)
+		leftover, err = deleteWhere(tx, quotedTable, expired, args)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Swapped table %s with the copy of its records to keep", table.TableName)
+	if missed > 0 {
+		log.Printf("Copied %d records of table %s to keep written during the swap", missed, table.TableName)
+	}
+	if leftover > 0 {
+		log.Printf("Deleted %d expired records of table %s written during the copy", leftover, table.TableName)
+	}
+
+	if c.config.Archive.Mode != models.ArchiveModeTable {
+		if _, err := c.db.Exec("DROP TABLE " + c.db.Quote(old)); err != nil {
+			return fmt.Errorf("failed to drop swapped out table %s: %w", old, err)
+		}
+	} else {
+		// The archive table keeps the records that are no longer in the table
+		match := make([]string, len(quotedPK))
+		for i, column := range quotedPK {
+			match[i] = fmt.Sprintf("%s.%s = %s.%s", quotedTable, column, quotedOld, column)
+		}
+		trimSQL := fmt.Sprintf("DELETE FROM %s WHERE EXISTS (SELECT 1 FROM %s WHERE %s)",
+			quotedOld, quotedTable, strings.Join(match, " AND "))
+		if _, err := c.db.Exec(trimSQL); err != nil {
+			return fmt.Errorf("failed to remove the kept records from archive table %s: %w", old, err)
+		}
+		log.Printf("Kept the expired records of table %s in archive table %s", table.TableName, old)
+	}
+
+	log.Printf("Successfully cleaned %d records from table %s", plan.Count, table.TableName)
+	return nil
+}
+
+// dropShadow drops a shadow table and the triggers copying records to it
+func (c *Cleaner) dropShadow(swapper database.TableSwapper, shadow string) error {
+	for _, dropSQL := range swapper.DropMirrorTriggersSQL(shadow) {
+		if _, err := c.db.Exec(dropSQL); err != nil {
+			return fmt.Errorf("failed to drop trigger: %w", err)
+		}
+	}
+	if _, err := c.db.Exec("DROP TABLE IF EXISTS " + c.db.Quote(shadow)); err != nil {
+		return fmt.Errorf("failed to drop shadow table %s: %w", shadow, err)
+	}
+	return nil
+}
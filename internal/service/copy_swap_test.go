@@ -0,0 +1,129 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// The swapped out table is dropped, or kept with the expired records only as archive table
+func TestCopySwap(t *testing.T) {
+	for name, mode := range map[string]string{"drop": "", "archive table": models.ArchiveModeTable} {
+		t.Run(name, func(t *testing.T) {
+			db := newTestDB(t)
+			seedTestDB(t, db)
+			c := newTestCleaner(t, db)
+			c.config.Archive.Mode = mode
+			log := testTable(t, c, "log")
+			log.Strategy = models.StrategyCopySwap
+			before, err := db.Tables()
+			if err != nil {
+				t.Fatalf("failed to list tables: %v", err)
+			}
+
+			if err := c.cleanTableByCopySwap(log); err != nil {
+				t.Fatalf("failed to clean table log: %v", err)
+			}
+			checkCounts(t, db, map[string]int{"log": 8})
+			if n := countRows(t, db, "log", "dttm < ?", c.startAt.AddDate(0, 0, -log.RetentionDays)); n != 0 {
+				t.Errorf("%d expired records left in table log", n)
+			}
+
+			// The index of the table is created again on the swapped in table
+			if n := countRows(t, db, "sqlite_master", "type = 'index' AND name = 'idx_log_dttm' AND tbl_name = 'log'"); n != 1 {
+				t.Errorf("index idx_log_dttm is not on table log")
+			}
+
+			archives, err := c.ListArchiveTables()
+			if err != nil {
+				t.Fatalf("failed to list archive tables: %v", err)
+			}
+			if mode == "" {
+				after, err := db.Tables()
+				if err != nil {
+					t.Fatalf("failed to list tables: %v", err)
+				}
+				if len(after) != len(before) {
+					t.Errorf("tables %v left after the swap, expected %v", after, before)
+				}
+				return
+			}
+			if len(archives) != 1 {
+				t.Fatalf("archive tables %+v, expected one of table log", archives)
+			}
+			if n := countRows(t, db, archives[0].Name, ""); n != 12 {
+				t.Errorf("archive table %s has %d records, expected the 12 expired ones", archives[0].Name, n)
+			}
+		})
+	}
+}
+
+// On MySQL, where DROP TRIGGER and RENAME TABLE commit on their own, the mirror triggers are
+// dropped before the rename: a swap failing once the table is renamed leaves none on the
+// swapped out table
+func TestCopySwapFailureAfterRename(t *testing.T) {
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherFunc(
+		func(expected, actual string) error {
+			if !strings.HasPrefix(strings.TrimSpace(actual), strings.TrimSpace(expected)) {
+				return fmt.Errorf("statement %q does not start with %q", actual, expected)
+			}
+			return nil
+		})))
+	if err != nil {
+		t.Fatalf("failed to open mocked connection: %v", err)
+	}
+	db, err := database.NewWithDB(conn, "mysql")
+	if err != nil {
+		t.Fatalf("failed to wrap mocked connection: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	c := NewCleaner(db, models.Config{BatchSize: 2})
+	swapper, _ := db.Swapper()
+	dialect := db.Dialect()
+	shadow := swapTableName(shadowTablePrefix, "log")
+	expectDropShadow := func() {
+		for _, dropSQL := range swapper.DropMirrorTriggersSQL(shadow) {
+			mock.ExpectExec(dropSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+		mock.ExpectExec("DROP TABLE IF EXISTS `" + shadow + "`").WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+
+	mock.ExpectQuery(dialect.TablesSQL()).
+		WillReturnRows(sqlmock.NewRows([]string{"table_name"}).AddRow("log"))
+	mock.ExpectQuery(dialect.ColumnsSQL()).WithArgs("log").
+		WillReturnRows(sqlmock.NewRows([]string{"column_name", "data_type", "is_nullable"}).
+			AddRow("id", "int", "NO").AddRow("dttm", "datetime", "YES"))
+	expectDropShadow()
+	mock.ExpectExec("CREATE TABLE `" + shadow + "` LIKE `log`").WillReturnResult(sqlmock.NewResult(0, 0))
+	for _, triggerSQL := range swapper.MirrorTriggersSQL("log", shadow, []string{"id", "dttm"}, []string{"id"}) {
+		mock.ExpectExec(triggerSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectQuery("SELECT `id` FROM `log` WHERE 1 = 1 AND CASE WHEN ((`dttm` < ?)) THEN 1 ELSE 0 END = 0").
+		WithArgs(sqlmock.AnyArg()).WillReturnRows(sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec("INSERT IGNORE INTO `" + shadow + "`").WithArgs(sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectBegin()
+	for _, dropSQL := range swapper.DropMirrorTriggersSQL(shadow) {
+		mock.ExpectExec(dropSQL).WillReturnResult(sqlmock.NewResult(0, 0))
+	}
+	mock.ExpectExec("RENAME TABLE `log` TO `_airflow_swapped__log`, `" + shadow + "` TO `log`").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT IGNORE INTO `log`").WithArgs(sqlmock.AnyArg()).WillReturnError(fmt.Errorf("connection lost"))
+	mock.ExpectRollback()
+	expectDropShadow()
+
+	plan := &TablePlan{Table: "log", Scopes: []ScopePlan{{where: "`dttm` < ?", args: []interface{}{time.Now()}}}}
+	if err := c.copySwap(swapper, models.TableConfig{TableName: "log"}, plan, []string{"id"}); err == nil {
+		t.Fatalf("swap succeeded, expected the failure after the rename")
+	}
+}
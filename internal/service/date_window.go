@@ -0,0 +1,142 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// defaultDateWindow is the length of the date windows when the table sets none
+const defaultDateWindow = 24 * time.Hour
+
+// cleanTableByDateWindow cleans expired data from a table window by window of its date
+// column, from the oldest expired record up to the latest cutoff, so that every statement
+// reads a narrow range of the date index
+func (c *Cleaner) cleanTableByDateWindow(table models.TableConfig) error {
+	log.Printf("Cleaning table %s by date windows", table.TableName)
+	plan, err := c.planTable(table, c.config.DryRun)
+	if err != nil {
+		return err
+	}
+	if plan.Skipped != "" {
+		return nil
+	}
+	var pk []string
+	if c.config.UsePrimaryKeyDelete || c.config.Archive.Mode != "" {
+		if pk, err = c.primaryKey(table); err != nil {
+			return err
+		}
+	}
+
+	// If in dry run mode, stop here
+	if c.config.DryRun {
+		log.Printf("Dry run mode: No actual deletion operations will be performed")
+		return nil
+	}
+
+	if err := c.deleteDateWindows(table, plan, pk); err != nil {
+		return err
+	}
+	return c.reportCascades(plan)
+}
+
+// deleteDateWindows deletes the expired records of a plan one date window at a time,
+// in batches by primary key when pk is set and with DELETE ... LIMIT otherwise
+func (c *Cleaner) deleteDateWindows(table models.TableConfig, plan *TablePlan, pk []string) error {
+	// If there are no records to clean, return directly
+	if plan.Count == 0 {
+		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
+		return nil
+	}
+
+	columns, err := c.dateColumns(table)
+	if err != nil {
+		return err
+	}
+	date := c.dateValue(table, columns)
+	condition, args := combineScopes(plan.Scopes)
+
+	// Windows start at the oldest expired record and end at the latest cutoff of the scopes
+	var value interface{}
+	oldestQuery := fmt.Sprintf("SELECT MIN(%s) FROM %s WHERE %s", date, c.db.Quote(table.TableName), condition)
+	if err := c.db.Get(&value, oldestQuery, args...); err != nil {
+		return fmt.Errorf("failed to query the oldest expired record: %w", err)
+	}
+	oldest, err := timeValue(value)
+	if err != nil {
+		return err
+	}
+	if oldest.IsZero() {
+		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
+		return nil
+	}
+	var cutoff time.Time
+	for _, scope := range plan.Scopes {
+		if scope.Cutoff.After(cutoff) {
+			cutoff = scope.Cutoff
+		}
+	}
+
+	window := table.DateWindow
+	if window == 0 {
+		window = defaultDateWindow
+	}
+	layout := "2006-01-02"
+	if window < 24*time.Hour {
+		layout = "2006-01-02 15:04"
+	}
+
+	// Records of other tables deleted by cascade are archived with the batches of every window
+	var cascades []cascadeArchive
+	if pk != nil {
+		if cascades, err = c.cascadeArchives(table.TableName, nil); err != nil {
+			return err
+		}
+	}
+
+	var deleted int
+	sleepDuration := time.Duration(c.config.SleepSeconds * float64(time.Second))
+	for start := oldest.Truncate(window); start.Before(cutoff); start = start.Add(window) {
+		end := start.Add(window)
+		if end.After(cutoff) {
+			end = cutoff
+		}
+
+		// The window is deleted as a single scope of expired records
+		inWindow, windowArgs := c.dateCondition(table, columns, start, end)
+		where := fmt.Sprintf("%s AND (%s)", inWindow, condition)
+		whereArgs := append(windowArgs, args...)
+		scope := ScopePlan{Cutoff: end, where: where, args: whereArgs}
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", c.db.Quote(table.TableName), where)
+		if err := c.db.Get(&scope.Count, countQuery, whereArgs...); err != nil {
+			return fmt.Errorf("failed to count expired records from %s: %w", start.Format(layout), err)
+		}
+		if scope.Count == 0 {
+			continue // Windows without expired records are skipped without pause
+		}
+
+		windowPlan := &TablePlan{Table: table.TableName, Cutoff: end, Count: scope.Count, Scopes: []ScopePlan{scope}}
+		var windowDeleted int
+		if pk != nil {
+			windowDeleted, err = c.deleteScopesByPK(table, windowPlan, pk, cascades)
+		} else {
+			windowDeleted, err = c.deleteScopes(table, windowPlan)
+		}
+		deleted += windowDeleted
+		if err != nil {
+			return err
+		}
+		log.Printf("Table %s: %s done, %d/%d records deleted", table.TableName, start.Format(layout), deleted, plan.Count)
+
+		// If not finished deleting, sleep to reduce database pressure
+		if end.Before(cutoff) {
+			log.Printf("Sleeping for %.3f seconds before continuing deletion...", c.config.SleepSeconds)
+			time.Sleep(sleepDuration)
+		}
+	}
+
+	log.Printf("Successfully cleaned %d records from table %s", deleted, table.TableName)
+	return nil
+}
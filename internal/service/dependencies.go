@@ -0,0 +1,333 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// cascadeRule is the delete rule of foreign keys whose records are deleted with the referenced records
+const cascadeRule = "CASCADE"
+
+// dependencyGraph holds the foreign keys between the tables of the database
+type dependencyGraph struct {
+	children map[string][]database.ForeignKey // Foreign keys referencing each table
+}
+
+// CascadePlan describes the records of a table deleted by cascade with the expired records of another table
+type CascadePlan struct {
+	Table  string
+	Parent string // Table whose deleted records reference them
+	Count  int
+
+	where string        // Condition matching the records deleted by cascade
+	args  []interface{} // Arguments of the condition
+}
+
+// dependencies loads the foreign keys of the database on first use
+func (c *Cleaner) dependencies() (*dependencyGraph, error) {
+	if c.graph != nil {
+		return c.graph, nil
+	}
+
+	foreignKeys, err := c.db.ForeignKeys()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read foreign keys: %w", err)
+	}
+
+	graph := &dependencyGraph{children: make(map[string][]database.ForeignKey)}
+	for _, fk := range foreignKeys {
+		if fk.Table == fk.ReferencedTable {
+			continue // Self references do not constrain the order of tables
+		}
+		graph.children[fk.ReferencedTable] = append(graph.children[fk.ReferencedTable], fk)
+	}
+	c.graph = graph
+	return graph, nil
+}
+
+// descendants returns the tables referencing a table, directly or through other tables
+func (g *dependencyGraph) descendants(table string) map[string]bool {
+	found := make(map[string]bool)
+	pending := []string{table}
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		for _, fk := range g.children[current] {
+			if !found[fk.Table] && fk.Table != table {
+				found[fk.Table] = true
+				pending = append(pending, fk.Table)
+			}
+		}
+	}
+	return found
+}
+
+// cleaningOrder orders the tables so that tables referencing another table are cleaned
+// right before it, keeping the configured order otherwise. Reference cycles are broken
+// at the first table of the cycle met in the configured order.
+func (g *dependencyGraph) cleaningOrder(tables []models.TableConfig) []models.TableConfig {
+	ordered := make([]models.TableConfig, 0, len(tables))
+	visited := make([]bool, len(tables))
+
+	var visit func(i int)
+	visit = func(i int) {
+		if visited[i] {
+			return
+		}
+		visited[i] = true
+		descendants := g.descendants(tables[i].TableName)
+		for j, other := range tables {
+			if descendants[other.TableName] {
+				visit(j)
+			}
+		}
+		ordered = append(ordered, tables[i])
+	}
+
+	for i := range tables {
+		visit(i)
+	}
+	return ordered
+}
+
+// orderedTables returns the configured tables in cleaning order
+func (c *Cleaner) orderedTables() ([]models.TableConfig, error) {
+	graph, err := c.dependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	tables := graph.cleaningOrder(c.config.Tables)
+	for i := range tables {
+		if tables[i].TableName != c.config.Tables[i].TableName {
+			names := make([]string, len(tables))
+			for j, table := range tables {
+				names[j] = table.TableName
+			}
+			log.Printf("Cleaning tables in foreign key order: %s", strings.Join(names, ", "))
+			break
+		}
+	}
+	return tables, nil
+}
+
+// planCascades counts the records deleted by cascade with the records of table matching
+// condition, following cascading foreign keys down to every level
+func (c *Cleaner) planCascades(table string, condition string, args []interface{}, visited map[string]bool, dryRun bool) ([]CascadePlan, error) {
+	graph, err := c.dependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	var cascades []CascadePlan
+	for _, fk := range graph.children[table] {
+		if fk.DeleteRule != cascadeRule || visited[fk.Table] {
+			continue
+		}
+
+		// Records referencing a deleted record of the parent table
+		child := c.db.Quote(fk.Table)
+		where := c.cascadeCondition(table, fk, condition)
+		whereArgs := append([]interface{}{}, args...)
+
+		// In dry run mode the expired records of the child table, cleaned before, are still
+		// there; they are counted for the child table itself
+		if dryRun {
+			expired, expiredArgs, err := c.expiredRecords(fk.Table)
+			if err != nil {
+				return nil, err
+			}
+			if expired != "" {
+				where += fmt.Sprintf(" AND CASE WHEN %s THEN 1 ELSE 0 END = 0", expired)
+				whereArgs = append(whereArgs, expiredArgs...)
+			}
+		}
+
+		cascade := CascadePlan{Table: fk.Table, Parent: table, where: where, args: whereArgs}
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", child, where)
+		if err := c.db.Get(&cascade.Count, countQuery, whereArgs...); err != nil {
+			return nil, fmt.Errorf("failed to count records of table %s deleted by cascade: %w", fk.Table, err)
+		}
+		cascades = append(cascades, cascade)
+
+		// Records referencing the records deleted by cascade are deleted too
+		childVisited := map[string]bool{fk.Table: true}
+		for name := range visited {
+			childVisited[name] = true
+		}
+		grandchildren, err := c.planCascades(fk.Table, where, whereArgs, childVisited, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		cascades = append(cascades, grandchildren...)
+	}
+	return cascades, nil
+}
+
+// cascadeCondition builds the condition matching the records of the table of a foreign key
+// that reference a record of table matching condition
+func (c *Cleaner) cascadeCondition(table string, fk database.ForeignKey, condition string) string {
+	parent := c.db.Quote(table)
+	child := c.db.Quote(fk.Table)
+	join := make([]string, len(fk.Columns))
+	for i, column := range fk.Columns {
+		join[i] = fmt.Sprintf("%s.%s = %s.%s", parent, c.db.Quote(fk.ReferencedColumns[i]), child, c.db.Quote(column))
+	}
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE %s AND (%s))", parent, strings.Join(join, " AND "), condition)
+}
+
+// cascadeArchive is the archive of the records of a table deleted by cascade with the
+// records of a cleaned table, which the database deletes without archiving them
+type cascadeArchive struct {
+	table        string
+	paths        [][]database.ForeignKey // Cascading foreign keys from the cleaned table down to the table
+	archiveTable string                  // Archive table of the records, empty when archiving to files
+}
+
+// cascadeArchives lists the archives of the records deleted by cascade with the records of
+// table, following cascading foreign keys down to every level, and creates their archive
+// tables when archiving to tables. The handled tables are deleted and archived on their
+// own before table, they and the tables below them are left out. It lists none when
+// archiving is disabled.
+func (c *Cleaner) cascadeArchives(table string, handled map[string]bool) ([]cascadeArchive, error) {
+	if c.config.Archive.Mode == "" {
+		return nil, nil
+	}
+	graph, err := c.dependencies()
+	if err != nil {
+		return nil, err
+	}
+
+	var archives []cascadeArchive
+	index := make(map[string]int) // Position of the archive of each table
+	var walk func(parent string, path []database.ForeignKey, visited map[string]bool)
+	walk = func(parent string, path []database.ForeignKey, visited map[string]bool) {
+		for _, fk := range graph.children[parent] {
+			if fk.DeleteRule != cascadeRule || visited[fk.Table] {
+				continue
+			}
+			childPath := append(append([]database.ForeignKey{}, path...), fk)
+			if i, ok := index[fk.Table]; ok {
+				archives[i].paths = append(archives[i].paths, childPath)
+			} else {
+				index[fk.Table] = len(archives)
+				archives = append(archives, cascadeArchive{table: fk.Table, paths: [][]database.ForeignKey{childPath}})
+			}
+
+			childVisited := map[string]bool{fk.Table: true}
+			for name := range visited {
+				childVisited[name] = true
+			}
+			walk(fk.Table, childPath, childVisited)
+		}
+	}
+	visited := map[string]bool{table: true}
+	for name := range handled {
+		visited[name] = true
+	}
+	walk(table, nil, visited)
+
+	for i := range archives {
+		log.Printf("Archiving records of table %s deleted by cascade with table %s", archives[i].table, table)
+		if c.config.Archive.Mode == models.ArchiveModeTable {
+			if archives[i].archiveTable, err = c.createArchiveTable(archives[i].table); err != nil {
+				return nil, fmt.Errorf("failed to create archive table: %w", err)
+			}
+		}
+	}
+	return archives, nil
+}
+
+// archiveCascades archives the records deleted by cascade with the records of table matching
+// condition, before these are deleted: into the archive tables through db, or to the archive files
+func (c *Cleaner) archiveCascades(db execer, table string, archives []cascadeArchive, condition string, args []interface{}) error {
+	for _, archive := range archives {
+		conditions := make([]string, len(archive.paths))
+		var whereArgs []interface{}
+		for i, path := range archive.paths {
+			where, parent := condition, table
+			for _, fk := range path {
+				where, parent = c.cascadeCondition(parent, fk, where), fk.Table
+			}
+			conditions[i] = "(" + where + ")"
+			whereArgs = append(whereArgs, args...)
+		}
+		where := strings.Join(conditions, " OR ")
+
+		if archive.archiveTable != "" {
+			copySQL := fmt.Sprintf("INSERT INTO %s SELECT * FROM %s WHERE %s",
+				c.db.Quote(archive.archiveTable), c.db.Quote(archive.table), where)
+			if _, err := db.Exec(copySQL, whereArgs...); err != nil {
+				return fmt.Errorf("failed to archive records of table %s deleted by cascade: %w", archive.table, err)
+			}
+			continue
+		}
+
+		selectSQL := fmt.Sprintf("SELECT * FROM %s WHERE %s", c.db.Quote(archive.table), where)
+		records, err := c.fetchBatch(selectSQL, nil, whereArgs...)
+		if err != nil {
+			return err
+		}
+		if len(records.rows) == 0 {
+			continue
+		}
+		file, err := c.tableArchive(archive.table)
+		if err != nil {
+			return err
+		}
+		if err := file.WriteBatch(records.columns, records.types, records.rows); err != nil {
+			return fmt.Errorf("failed to archive records of table %s deleted by cascade: %w", archive.table, err)
+		}
+	}
+	return nil
+}
+
+// expiredRecords builds the condition matching the expired records of an enabled table,
+// empty when the table is not cleaned or its date column does not exist
+func (c *Cleaner) expiredRecords(name string) (string, []interface{}, error) {
+	table, ok := c.tableConfig(name)
+	if !ok || !table.Enabled {
+		return "", nil, nil
+	}
+	exists, err := c.db.ColumnExists(dateTableName(table), table.DateColumn)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to check if column exists: %w", err)
+	}
+	if !exists {
+		return "", nil, nil
+	}
+
+	scopes, err := c.retentionScopes(table, time.Now())
+	if err != nil {
+		return "", nil, err
+	}
+	condition, args := combineScopes(scopes)
+	return condition, args, nil
+}
+
+// reportCascades logs the records deleted by cascade with the records of a table
+func (c *Cleaner) reportCascades(plan *TablePlan) error {
+	for _, cascade := range plan.Cascades {
+		if cascade.Count == 0 {
+			continue
+		}
+
+		// The remaining records are the ones whose parent was not deleted
+		var remaining int
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", c.db.Quote(cascade.Table), cascade.where)
+		if err := c.db.Get(&remaining, countQuery, cascade.args...); err != nil {
+			return fmt.Errorf("failed to count records of table %s deleted by cascade: %w", cascade.Table, err)
+		}
+		removed := cascade.Count - remaining
+		if removed < 0 {
+			removed = 0
+		}
+		log.Printf("Deleted %d records from table %s by cascade from table %s", removed, cascade.Table, cascade.Parent)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package service
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// Kinds of schema drift
+const (
+	DriftAdded       = "added"       // Column of the database missing from the model
+	DriftMissing     = "missing"     // Column of the model missing from the database
+	DriftRetyped     = "retyped"     // Column whose type does not match the model
+	DriftNullability = "nullability" // Column nullable in only one of the model and the database
+)
+
+// ModelPreset is the preset of the schema the models describe, other schemas are not compared
+const ModelPreset = PresetAirflow2
+
+// modelTables maps the tables of the database to the models describing them
+var modelTables = []struct {
+	table string
+	model interface{}
+}{
+	{"dag_run", models.DagRun{}},
+	{"task_instance", models.TaskInstance{}},
+	{"xcom", models.XCom{}},
+	{"log", models.Log{}},
+	{"job", models.Job{}},
+}
+
+// ColumnDrift describes a difference between a model and the live schema
+type ColumnDrift struct {
+	Table    string
+	Column   string // Empty when the whole table is missing
+	Kind     string
+	Model    string // Go type of the model field, empty for added columns
+	Database string // Type of the database column, empty for missing columns
+}
+
+// typeFamilies maps the data types reported by the databases to the Go types they are
+// scanned into. Types are compared lower case and without size, e.g. varchar(250).
+var typeFamilies = map[string][]string{
+	"int64":     {"integer", "int", "bigint", "smallint", "mediumint", "tinyint", "serial", "bigserial"},
+	"int":       {"integer", "int", "bigint", "smallint", "mediumint", "tinyint", "serial", "bigserial"},
+	"float64":   {"double precision", "double", "float", "real", "numeric", "decimal"},
+	"bool":      {"boolean", "bool", "tinyint"},
+	"string":    {"character varying", "varchar", "character", "char", "text", "mediumtext", "longtext", "json", "jsonb", "uuid"},
+	"time.Time": {"timestamp with time zone", "timestamp without time zone", "timestamp", "datetime"},
+	"[]byte":    {"bytea", "blob", "mediumblob", "longblob", "binary", "varbinary", "json", "jsonb", "text", "mediumtext", "longtext"},
+}
+
+// typeSize matches the size or precision of a data type, e.g. (250) or (6)
+var typeSize = regexp.MustCompile(`\s*\([^)]*\)`)
+
+// SchemaCheck compares the models of the Airflow tables with the columns, types and
+// nullability of the live schema
+func (c *Cleaner) SchemaCheck() ([]ColumnDrift, error) {
+	var drifts []ColumnDrift
+	for _, entry := range modelTables {
+		columns, err := c.db.Columns(entry.table)
+		if err != nil {
+			return drifts, fmt.Errorf("failed to read columns of table %s: %w", entry.table, err)
+		}
+		if len(columns) == 0 {
+			drifts = append(drifts, ColumnDrift{Table: entry.table, Kind: DriftMissing})
+			continue
+		}
+		drifts = append(drifts, compareModel(entry.table, reflect.TypeOf(entry.model), columns)...)
+	}
+	return drifts, nil
+}
+
+// compareModel compares the db-tagged fields of a model with the columns of its table
+func compareModel(table string, model reflect.Type, columns []database.Column) []ColumnDrift {
+	live := make(map[string]database.Column, len(columns))
+	for _, column := range columns {
+		live[column.Name] = column
+	}
+
+	var drifts []ColumnDrift
+	fields := make(map[string]bool)
+	for i := 0; i < model.NumField(); i++ {
+		field := model.Field(i)
+		name := field.Tag.Get("db")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = true
+
+		goType, nullable := fieldType(field.Type)
+		column, ok := live[name]
+		if !ok {
+			drifts = append(drifts, ColumnDrift{Table: table, Column: name, Kind: DriftMissing, Model: typeName(field.Type)})
+			continue
+		}
+
+		drift := ColumnDrift{Table: table, Column: name, Model: typeName(field.Type), Database: describeColumn(column)}
+		switch {
+		case !matchesType(goType, column.Type):
+			drift.Kind = DriftRetyped
+		case nullable != column.Nullable:
+			drift.Kind = DriftNullability
+		default:
+			continue
+		}
+		drifts = append(drifts, drift)
+	}
+
+	for _, column := range columns {
+		if !fields[column.Name] {
+			drifts = append(drifts, ColumnDrift{Table: table, Column: column.Name, Kind: DriftAdded, Database: describeColumn(column)})
+		}
+	}
+	return drifts
+}
+
+// fieldType returns the Go type a field scans into and whether it holds NULL values,
+// as pointers and byte slices do
+func fieldType(t reflect.Type) (string, bool) {
+	if t.Kind() == reflect.Ptr {
+		return typeName(t.Elem()), true
+	}
+	return typeName(t), t.Kind() == reflect.Slice
+}
+
+// typeName names a Go type as in typeFamilies, and as declared in the models
+func typeName(t reflect.Type) string {
+	switch {
+	case t.Kind() == reflect.Ptr:
+		return "*" + typeName(t.Elem())
+	case t == reflect.TypeOf(time.Time{}):
+		return "time.Time"
+	case t == reflect.TypeOf([]byte{}):
+		return "[]byte"
+	}
+	return t.String()
+}
+
+// matchesType reports whether a database type scans into the Go type
+func matchesType(goType, dataType string) bool {
+	dataType = strings.ToLower(strings.TrimSpace(typeSize.ReplaceAllString(dataType, "")))
+	for _, family := range typeFamilies[goType] {
+		if dataType == family {
+			return true
+		}
+	}
+	return false
+}
+
+// describeColumn describes the type and nullability of a column
+func describeColumn(column database.Column) string {
+	if column.Nullable {
+		return column.Type + " NULL"
+	}
+	return column.Type + " NOT NULL"
+}
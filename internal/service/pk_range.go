@@ -0,0 +1,228 @@
+package service
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// cleanTableByPKRange cleans expired data from a table with an integer primary key by
+// deleting the expired records of consecutive id windows, from the lowest to the highest
+// expired id, without selecting the primary keys of each batch first
+func (c *Cleaner) cleanTableByPKRange(table models.TableConfig) error {
+	log.Printf("Cleaning table %s by primary key ranges", table.TableName)
+	plan, err := c.planTable(table, c.config.DryRun)
+	if err != nil {
+		return err
+	}
+	if plan.Skipped != "" {
+		return nil
+	}
+	id, err := c.rangeKey(table)
+	if err != nil {
+		return err
+	}
+
+	// If in dry run mode, stop here
+	if c.config.DryRun {
+		log.Printf("Dry run mode: No actual deletion operations will be performed")
+		return nil
+	}
+
+	if err := c.deleteRanges(table, plan, id); err != nil {
+		return err
+	}
+	return c.reportCascades(plan)
+}
+
+// rangeKey returns the primary key column of a table cleaned by primary key ranges,
+// which must be a single integer column
+func (c *Cleaner) rangeKey(table models.TableConfig) (string, error) {
+	pk, err := c.primaryKey(table)
+	if err != nil {
+		return "", err
+	}
+	if len(pk) != 1 {
+		return "", fmt.Errorf("strategy %s needs a single column primary key, table %s has (%s)",
+			models.StrategyPKRange, table.TableName, strings.Join(pk, ", "))
+	}
+
+	columns, err := c.db.Columns(table.TableName)
+	if err != nil {
+		return "", fmt.Errorf("failed to read columns of table %s: %w", table.TableName, err)
+	}
+	for _, column := range columns {
+		if column.Name == pk[0] && !matchesType("int64", column.Type) {
+			return "", fmt.Errorf("strategy %s needs an integer primary key, %s.%s is %s",
+				models.StrategyPKRange, table.TableName, column.Name, column.Type)
+		}
+	}
+	return pk[0], nil
+}
+
+// deleteRanges deletes the expired records of a plan window by window, BatchSize ids per
+// window, archiving them first when archiving is enabled
+func (c *Cleaner) deleteRanges(table models.TableConfig, plan *TablePlan, id string) error {
+	// If there are no records to clean, return directly
+	count := plan.Count
+	if count == 0 {
+		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
+		return nil
+	}
+
+	quotedTable := c.db.Quote(table.TableName)
+	quotedID := c.db.Quote(id)
+	condition, args := combineScopes(plan.Scopes)
+
+	// Range of the expired ids
+	var minID, maxID sql.NullInt64
+	rangeQuery := fmt.Sprintf("SELECT MIN(%s), MAX(%s) FROM %s WHERE %s", quotedID, quotedID, quotedTable, condition)
+	rows, err := c.db.Queryx(rangeQuery, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query the range of expired ids: %w", err)
+	}
+	if rows.Next() {
+		err = rows.Scan(&minID, &maxID)
+	}
+	if closeErr := rows.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the range of expired ids: %w", err)
+	}
+	if !minID.Valid {
+		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
+		return nil
+	}
+	log.Printf("Deleting expired records of table %s with %s from %d to %d", table.TableName, id, minID.Int64, maxID.Int64)
+
+	// Open the archive the deleted records are written to
+	var archive *fileArchive
+	if c.config.Archive.Mode == models.ArchiveModeFile {
+		if archive, err = c.tableArchive(table.TableName); err != nil {
+			return err
+		}
+	}
+	var archiveTable string
+	if c.config.Archive.Mode == models.ArchiveModeTable {
+		archiveTable, err = c.createArchiveTable(table.TableName)
+		if err != nil {
+			return fmt.Errorf("failed to create archive table: %w", err)
+		}
+	}
+
+	// Records of other tables deleted by cascade are archived with the window
+	cascades, err := c.cascadeArchives(table.TableName, nil)
+	if err != nil {
+		return err
+	}
+
+	// Each window starts at the next expired id, so that the gaps between the expired ids
+	// of sparse tables cost no statement
+	nextQuery := fmt.Sprintf("SELECT MIN(%s) FROM %s WHERE %s > ? AND (%s)", quotedID, quotedTable, quotedID, condition)
+	nextID := func(after int64) (sql.NullInt64, error) {
+		var next sql.NullInt64
+		if err := c.db.Get(&next, nextQuery, append([]interface{}{after}, args...)...); err != nil {
+			return next, fmt.Errorf("failed to query the next expired id: %w", err)
+		}
+		return next, nil
+	}
+
+	var deleted int
+	window := int64(c.config.BatchSize)
+	sleepDuration := time.Duration(c.config.SleepSeconds * float64(time.Second))
+	for low := minID.Int64; low <= maxID.Int64; {
+		high := low + window - 1
+		if high > maxID.Int64 {
+			high = maxID.Int64
+		}
+		startTime := time.Now()
+
+		where := fmt.Sprintf("%s BETWEEN ? AND ? AND (%s)", quotedID, condition)
+		whereArgs := append([]interface{}{low, high}, args...)
+
+		var windowDeleted int
+		switch {
+		case archive != nil:
+			// The records written to the archive file are deleted by primary key
+			batch, err := c.fetchBatch(fmt.Sprintf("SELECT * FROM %s WHERE %s", quotedTable, where), []string{id}, whereArgs...)
+			if err != nil {
+				return err
+			}
+			if len(batch.keys) == 0 {
+				break // Deleted since the range was read
+			}
+			if err := archive.WriteBatch(batch.columns, batch.types, batch.rows); err != nil {
+				return fmt.Errorf("failed to archive records: %w", err)
+			}
+			if err := c.archiveCascades(c.db, table.TableName, cascades, where, whereArgs); err != nil {
+				return err
+			}
+			if windowDeleted, err = c.deleteByKeys(c.db, table.TableName, []string{quotedID}, batch.keys, "", nil); err != nil {
+				return err
+			}
+		case archiveTable != "":
+			err = c.db.Transaction(func(tx *database.Tx) error {
+				if err := c.archiveCascades(tx, table.TableName, cascades, where, whereArgs); err != nil {
+					return err
+				}
+				copySQL := fmt.Sprintf("INSERT INTO %s SELECT * FROM %s WHERE %s", c.db.Quote(archiveTable), quotedTable, where)
+				if _, err := tx.Exec(copySQL, whereArgs...); err != nil {
+					return fmt.Errorf("failed to archive records: %w", err)
+				}
+				n, err := deleteWhere(tx, quotedTable, where, whereArgs)
+				windowDeleted = n
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		default:
+			if windowDeleted, err = deleteWhere(c.db, quotedTable, where, whereArgs); err != nil {
+				return err
+			}
+		}
+
+		deleted += windowDeleted
+		if windowDeleted > 0 {
+			log.Printf("Deleted %d/%d records from table %s with %s from %d to %d (batch time: %.2fs)",
+				deleted, count, table.TableName, id, low, high, time.Since(startTime).Seconds())
+		}
+		if high >= maxID.Int64 {
+			break
+		}
+		next, err := nextID(high)
+		if err != nil {
+			return err
+		}
+		if !next.Valid || next.Int64 > maxID.Int64 {
+			break
+		}
+
+		// If not finished deleting, sleep to reduce database pressure. Windows whose records
+		// were deleted since the range was read are skipped without pause.
+		if windowDeleted > 0 {
+			log.Printf("Sleeping for %.3f seconds before continuing deletion...", c.config.SleepSeconds)
+			time.Sleep(sleepDuration)
+		}
+		low = next.Int64
+	}
+
+	log.Printf("Successfully cleaned %d records from table %s", deleted, table.TableName)
+	return nil
+}
+
+// deleteWhere deletes the records of a table matching a condition
+func deleteWhere(db execer, quotedTable, where string, args []interface{}) (int, error) {
+	result, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s", quotedTable, where), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete records: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return int(rowsAffected), nil
+}
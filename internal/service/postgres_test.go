@@ -0,0 +1,123 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/jmoiron/sqlx"
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// newPostgresCleaner creates a cleaner on a mocked PostgreSQL connection matching statements
+// exactly, whitespace aside, deleting batches of 2 records without pause
+func newPostgresCleaner(t *testing.T) (*Cleaner, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(sqlmock.QueryMatcherEqual))
+	if err != nil {
+		t.Fatalf("failed to open mocked connection: %v", err)
+	}
+	db, err := database.NewWithDB(conn, "postgres")
+	if err != nil {
+		t.Fatalf("failed to wrap mocked connection: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+
+	tables, err := resolveTables(PresetAirflow2, map[string]int{"dag_run": 30}, nil)
+	if err != nil {
+		t.Fatalf("failed to resolve tables: %v", err)
+	}
+	return NewCleaner(db, models.Config{Tables: tables, BatchSize: 2, CompositeKeyForm: models.KeyFormRowIn}), mock
+}
+
+// expectPlan expects the statements planning the 3 expired records of a table without foreign keys
+func expectPlan(c *Cleaner, mock sqlmock.Sqlmock, table, dateColumn string) {
+	dialect := c.db.Dialect()
+	mock.ExpectQuery(sqlx.Rebind(sqlx.DOLLAR, dialect.ColumnExistsSQL())).
+		WithArgs(table, dateColumn).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`SELECT COUNT(*) FROM "` + table + `" WHERE "` + dateColumn + `" < $1`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+	mock.ExpectQuery(dialect.ForeignKeysSQL()).
+		WillReturnRows(sqlmock.NewRows([]string{"constraint_name", "table_name", "column_name", "table_name", "column_name", "delete_rule"}))
+}
+
+// Batches of DELETE ... LIMIT are deleted by ctid on PostgreSQL
+func TestPostgresCleanTable(t *testing.T) {
+	c, mock := newPostgresCleaner(t)
+	expectPlan(c, mock, "log", "dttm")
+	for _, batch := range []struct {
+		limit   string
+		deleted int64
+	}{{"2", 2}, {"1", 1}} {
+		mock.ExpectExec(`DELETE FROM "log" WHERE ctid = ANY(ARRAY(SELECT ctid FROM "log" WHERE "dttm" < $1 LIMIT ` + batch.limit + `))`).
+			WithArgs(sqlmock.AnyArg()).
+			WillReturnResult(sqlmock.NewResult(0, batch.deleted))
+	}
+
+	if err := c.cleanTable(testTable(t, c, "log")); err != nil {
+		t.Fatalf("failed to clean table log: %v", err)
+	}
+}
+
+// Keys are selected and deleted with $n placeholders, after the last key of the previous batch
+func TestPostgresCleanTableByPK(t *testing.T) {
+	c, mock := newPostgresCleaner(t)
+	expectPlan(c, mock, "log", "dttm")
+	mock.ExpectQuery(sqlx.Rebind(sqlx.DOLLAR, c.db.Dialect().PrimaryKeySQL())).
+		WithArgs("log").
+		WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("id"))
+
+	mock.ExpectQuery(`SELECT "id" FROM "log" WHERE "dttm" < $1 ORDER BY "id" LIMIT 2`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1).AddRow(2))
+	mock.ExpectExec(`DELETE FROM "log" WHERE "id" IN ($1, $2)`).
+		WithArgs(1, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(`SELECT "id" FROM "log" WHERE ("dttm" < $1) AND "id" > $2 ORDER BY "id" LIMIT 1`).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(3))
+	mock.ExpectExec(`DELETE FROM "log" WHERE "id" IN ($1)`).
+		WithArgs(3).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := c.cleanTableByPK(testTable(t, c, "log")); err != nil {
+		t.Fatalf("failed to clean table log: %v", err)
+	}
+}
+
+// Composite keys are deleted with row constructors whose placeholders are numbered in order
+func TestPostgresCleanTableByCompositePK(t *testing.T) {
+	c, mock := newPostgresCleaner(t)
+	table := models.TableConfig{TableName: "task_instance", DateColumn: "end_date", RetentionDays: 30, Enabled: true}
+	expectPlan(c, mock, "task_instance", "end_date")
+	mock.ExpectQuery(sqlx.Rebind(sqlx.DOLLAR, c.db.Dialect().PrimaryKeySQL())).
+		WithArgs("task_instance").
+		WillReturnRows(sqlmock.NewRows([]string{"column_name"}).AddRow("dag_id").AddRow("task_id").AddRow("run_id").AddRow("map_index"))
+
+	key := `"dag_id", "task_id", "run_id", "map_index"`
+	mock.ExpectQuery(`SELECT ` + key + ` FROM "task_instance" WHERE "end_date" < $1 ORDER BY ` + key + ` LIMIT 2`).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"dag_id", "task_id", "run_id", "map_index"}).
+			AddRow("etl", "extract", "r1", -1).
+			AddRow("etl", "load", "r1", -1))
+	mock.ExpectExec(`DELETE FROM "task_instance" WHERE (`+key+`) IN (($1, $2, $3, $4), ($5, $6, $7, $8))`).
+		WithArgs("etl", "extract", "r1", -1, "etl", "load", "r1", -1).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectQuery(`SELECT `+key+` FROM "task_instance" WHERE ("end_date" < $1) AND (`+key+`) > ($2, $3, $4, $5) ORDER BY `+key+` LIMIT 1`).
+		WithArgs(sqlmock.AnyArg(), "etl", "load", "r1", -1).
+		WillReturnRows(sqlmock.NewRows([]string{"dag_id", "task_id", "run_id", "map_index"}).AddRow("etl", "extract", "r2", -1))
+	mock.ExpectExec(`DELETE FROM "task_instance" WHERE (`+key+`) IN (($1, $2, $3, $4))`).
+		WithArgs("etl", "extract", "r2", -1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := c.cleanTableByPK(table); err != nil {
+		t.Fatalf("failed to clean table task_instance: %v", err)
+	}
+}
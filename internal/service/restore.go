@@ -0,0 +1,608 @@
+package service
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// archiveFilePattern matches archive file names and captures the table name
+var archiveFilePattern = regexp.MustCompile(`^(.+)__\d{14}\.(jsonl|csv)\.gz$`)
+
+// timeLayouts are the layouts accepted for archived time values
+var timeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// RestoreOptions selects the archived records to restore
+type RestoreOptions struct {
+	Source string    // Archive file path or archive table name
+	Table  string    // Target table, derived from the source name when empty
+	DagID  string    // Only restore records of this DAG when set
+	From   time.Time // Only restore records dated at or after From when set
+	To     time.Time // Only restore records dated before To when set
+}
+
+// RestoreResult reports the outcome of a restore
+type RestoreResult struct {
+	Table     string
+	Read      int // Records read from the archive
+	Matched   int // Records matching the filters
+	Restored  int // Records inserted, or that would be inserted in dry run mode
+	Conflicts int // Records skipped because their primary key already exists
+}
+
+// archiveReader reads archived records one at a time, returning io.EOF at the end
+type archiveReader interface {
+	Next() (map[string]interface{}, error)
+	Close() error
+}
+
+// Restore re-inserts archived records into their table, skipping records whose
+// primary key already exists. In dry run mode it only reports what would be restored.
+func (c *Cleaner) Restore(opts RestoreOptions) (*RestoreResult, error) {
+	table, format, err := c.resolveArchive(opts.Source, opts.Table)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tables archived with the runs they depend on, by the run_cascade strategy, may be in
+	// no preset; their primary key comes from the database and they have no date column
+	tableConfig, ok := c.tableConfig(table)
+	if !ok {
+		exists, err := c.db.TableExists(table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if table exists: %w", err)
+		}
+		if !exists {
+			return nil, fmt.Errorf("table %s does not exist", table)
+		}
+		if !opts.From.IsZero() || !opts.To.IsZero() {
+			return nil, fmt.Errorf("table %s is not configured, its records cannot be filtered by date", table)
+		}
+		tableConfig = models.TableConfig{TableName: table}
+	}
+	if tableConfig.DateJoin != nil && (!opts.From.IsZero() || !opts.To.IsZero()) {
+		return nil, fmt.Errorf("records of table %s have no date column, their date comes from table %s", table, tableConfig.DateJoin.Table)
+	}
+	pk, err := c.primaryKey(tableConfig)
+	if err != nil {
+		return nil, err
+	}
+	quotedPK := make([]string, len(pk))
+	for i, col := range pk {
+		quotedPK[i] = c.db.Quote(col)
+	}
+
+	// Open the archive, archive tables are read in pages ordered by primary key
+	var reader archiveReader
+	if format != "" {
+		if reader, err = openFileArchiveReader(opts.Source, format); err != nil {
+			return nil, err
+		}
+	} else {
+		reader = &tableArchiveReader{
+			c:        c,
+			table:    c.db.Quote(opts.Source),
+			pk:       pk,
+			quotedPK: quotedPK,
+			pageSize: c.config.BatchSize,
+		}
+	}
+	defer reader.Close()
+
+	// Get the columns of the target table to decode archived values
+	columns, err := c.columnTypes(table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns of table %s: %w", table, err)
+	}
+	if opts.DagID != "" {
+		if _, ok := columns["dag_id"]; !ok {
+			return nil, fmt.Errorf("table %s has no dag_id column", table)
+		}
+	}
+
+	log.Printf("Restoring records of table %s from %s", table, opts.Source)
+	result := &RestoreResult{Table: table}
+	var batch []map[string]interface{}
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read archive: %w", err)
+		}
+		result.Read++
+
+		record, err = decodeRecord(record, columns)
+		if err != nil {
+			return result, err
+		}
+
+		match, err := matchRecord(record, append([]string{tableConfig.DateColumn}, tableConfig.FallbackDateColumns...), opts)
+		if err != nil {
+			return result, err
+		}
+		if !match {
+			continue
+		}
+		result.Matched++
+
+		batch = append(batch, record)
+		if len(batch) >= c.config.BatchSize {
+			if err := c.restoreBatch(table, pk, quotedPK, batch, result); err != nil {
+				return result, err
+			}
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		if err := c.restoreBatch(table, pk, quotedPK, batch, result); err != nil {
+			return result, err
+		}
+	}
+
+	if c.config.DryRun {
+		log.Printf("Dry run mode: Would restore %d of %d archived records to table %s, %d conflicting records skipped",
+			result.Restored, result.Read, table, result.Conflicts)
+	} else {
+		log.Printf("Restored %d of %d archived records to table %s, %d conflicting records skipped",
+			result.Restored, result.Read, table, result.Conflicts)
+	}
+	return result, nil
+}
+
+// restoreBatch inserts a batch of records, skipping those whose primary key already exists
+func (c *Cleaner) restoreBatch(table string, pk, quotedPK []string, batch []map[string]interface{}, result *RestoreResult) error {
+	keys := make([][]interface{}, len(batch))
+	for i, record := range batch {
+		key := make([]interface{}, len(pk))
+		for j, col := range pk {
+			value, ok := record[col]
+			if !ok {
+				return fmt.Errorf("archived record has no primary key column %s", col)
+			}
+			key[j] = value
+		}
+		keys[i] = key
+	}
+
+	// Find the primary keys that already exist
+	existing := make(map[string]bool)
+	for _, cond := range c.keyConditions(quotedPK, keys) {
+		selectSQL := fmt.Sprintf("SELECT %s FROM %s WHERE %s",
+			strings.Join(quotedPK, ", "), c.db.Quote(table), cond.sql)
+		rows, err := c.db.Queryx(selectSQL, cond.args...)
+		if err != nil {
+			return fmt.Errorf("failed to query existing records: %w", err)
+		}
+		for rows.Next() {
+			key, err := rows.SliceScan()
+			if err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan existing records: %w", err)
+			}
+			existing[keyString(key)] = true
+		}
+		rows.Close()
+	}
+
+	var toInsert []map[string]interface{}
+	for i, record := range batch {
+		key := keyString(keys[i])
+		if existing[key] {
+			result.Conflicts++
+			if c.config.Verbose {
+				log.Printf("Skipping record of table %s with existing primary key %s", table, key)
+			}
+			continue
+		}
+		existing[key] = true // Skip duplicates within the archive
+		toInsert = append(toInsert, record)
+	}
+
+	if c.config.DryRun || len(toInsert) == 0 {
+		result.Restored += len(toInsert)
+		return nil
+	}
+
+	err := c.db.Transaction(func(tx *database.Tx) error {
+		for _, record := range toInsert {
+			columns := make([]string, 0, len(record))
+			for col := range record {
+				columns = append(columns, col)
+			}
+			quoted := make([]string, len(columns))
+			args := make([]interface{}, len(columns))
+			for i, col := range columns {
+				quoted[i] = c.db.Quote(col)
+				args[i] = record[col]
+			}
+
+			insertSQL := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", c.db.Quote(table),
+				strings.Join(quoted, ", "), strings.TrimSuffix(strings.Repeat("?,", len(columns)), ","))
+			if _, err := tx.Exec(insertSQL, args...); err != nil {
+				return fmt.Errorf("failed to restore record: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	result.Restored += len(toInsert)
+	log.Printf("Restored %d records to table %s", result.Restored, table)
+	return nil
+}
+
+// resolveArchive determines the archived table and the format of an archive file,
+// or an empty format when the source is an archive table
+func (c *Cleaner) resolveArchive(source, table string) (string, string, error) {
+	if _, err := os.Stat(source); err == nil {
+		match := archiveFilePattern.FindStringSubmatch(filepath.Base(source))
+		if table == "" {
+			if match == nil {
+				return "", "", fmt.Errorf("cannot derive table name from archive file %s, specify the table", source)
+			}
+			table = match[1]
+		}
+		format := models.ArchiveFormatJSONL
+		if match != nil {
+			format = match[2]
+		}
+		return table, format, nil
+	}
+
+	exists, err := c.db.TableExists(source)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to check if archive table exists: %w", err)
+	}
+	if !exists {
+		return "", "", fmt.Errorf("archive %s is neither a file nor a table", source)
+	}
+	if table == "" {
+		match := archiveTablePattern.FindStringSubmatch(source)
+		if match == nil {
+			return "", "", fmt.Errorf("cannot derive table name from archive table %s, specify the table", source)
+		}
+		table = match[1]
+	}
+	return table, "", nil
+}
+
+// tableConfig returns the configuration of a table
+func (c *Cleaner) tableConfig(name string) (models.TableConfig, bool) {
+	for _, table := range c.config.Tables {
+		if table.TableName == name {
+			return table, true
+		}
+	}
+	return models.TableConfig{}, false
+}
+
+// columnTypes returns the database type names of the columns of a table
+func (c *Cleaner) columnTypes(table string) (map[string]string, error) {
+	rows, err := c.db.Queryx(fmt.Sprintf("SELECT * FROM %s WHERE 1 = 0", c.db.Quote(table)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+	columns := make(map[string]string, len(types))
+	for _, t := range types {
+		columns[t.Name()] = t.DatabaseTypeName()
+	}
+	return columns, nil
+}
+
+// decodeRecord converts archived values to the types of the target columns,
+// dropping columns that the target table does not have
+func decodeRecord(record map[string]interface{}, columns map[string]string) (map[string]interface{}, error) {
+	decoded := make(map[string]interface{}, len(record))
+	for col, value := range record {
+		typeName, ok := columns[col]
+		if !ok {
+			continue
+		}
+		s, isString := value.(string)
+		switch {
+		case value == nil:
+			decoded[col] = nil
+		case isString && isBinaryType(typeName):
+			data, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode binary column %s: %w", col, err)
+			}
+			decoded[col] = data
+		case isString && isTimeType(typeName):
+			t, err := parseTimeValue(s)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode time column %s: %w", col, err)
+			}
+			decoded[col] = t
+		default:
+			if n, ok := value.(json.Number); ok {
+				if i, err := n.Int64(); err == nil {
+					value = i
+				} else if f, err := n.Float64(); err == nil {
+					value = f
+				}
+			}
+			decoded[col] = value
+		}
+	}
+	return decoded, nil
+}
+
+// matchRecord reports whether a record matches the restore filters
+func matchRecord(record map[string]interface{}, dateColumns []string, opts RestoreOptions) (bool, error) {
+	if opts.DagID != "" && stringValue(record["dag_id"]) != opts.DagID {
+		return false, nil
+	}
+
+	if opts.From.IsZero() && opts.To.IsZero() {
+		return true, nil
+	}
+	if _, ok := record[dateColumns[0]]; !ok {
+		return false, fmt.Errorf("archived record has no date column %s", dateColumns[0])
+	}
+
+	// Records are dated by the first non-NULL date column, as when they were cleaned
+	var date time.Time
+	for _, column := range dateColumns {
+		value, err := timeValue(record[column])
+		if err != nil {
+			return false, err
+		}
+		if !value.IsZero() {
+			date = value
+			break
+		}
+	}
+	if date.IsZero() {
+		return false, nil
+	}
+	if !opts.From.IsZero() && date.Before(opts.From) {
+		return false, nil
+	}
+	if !opts.To.IsZero() && !date.Before(opts.To) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// isTimeType reports whether a database type name is a date or time type
+func isTimeType(typeName string) bool {
+	typeName = strings.ToUpper(typeName)
+	return strings.Contains(typeName, "DATE") || strings.Contains(typeName, "TIME")
+}
+
+// parseTimeValue parses an archived time value
+func parseTimeValue(s string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.UTC); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+// timeValue converts a date column value to a time, the zero time for NULL
+func timeValue(value interface{}) (time.Time, error) {
+	switch v := value.(type) {
+	case nil:
+		return time.Time{}, nil
+	case time.Time:
+		return v, nil
+	default:
+		return parseTimeValue(stringValue(v))
+	}
+}
+
+// stringValue converts a scanned value to a string
+func stringValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// keyString builds a comparable string from primary key values
+func keyString(key []interface{}) string {
+	parts := make([]string, len(key))
+	for i, value := range key {
+		parts[i] = stringValue(value)
+	}
+	return strings.Join(parts, "|")
+}
+
+// splitColumns splits a comma-separated column list
+func splitColumns(columns string) []string {
+	var names []string
+	for _, col := range strings.Split(columns, ",") {
+		if col = strings.TrimSpace(col); col != "" {
+			names = append(names, col)
+		}
+	}
+	return names
+}
+
+// fileArchiveReader reads records from a gzip-compressed JSONL or CSV archive file
+type fileArchiveReader struct {
+	file    *os.File
+	gz      *gzip.Reader
+	json    *json.Decoder
+	csv     *csv.Reader
+	columns []string
+}
+
+// openFileArchiveReader opens an archive file
+func openFileArchiveReader(path, format string) (*fileArchiveReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open archive %s: %w", path, err)
+	}
+
+	reader := &fileArchiveReader{file: file, gz: gz}
+	if format == models.ArchiveFormatCSV {
+		reader.csv = csv.NewReader(bufio.NewReader(gz))
+		if reader.columns, err = reader.csv.Read(); err != nil {
+			reader.Close()
+			return nil, fmt.Errorf("failed to read archive header: %w", err)
+		}
+	} else {
+		reader.json = json.NewDecoder(bufio.NewReader(gz))
+		reader.json.UseNumber()
+	}
+	return reader, nil
+}
+
+// Next implements archiveReader
+func (r *fileArchiveReader) Next() (map[string]interface{}, error) {
+	if r.csv != nil {
+		fields, err := r.csv.Read()
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		if err != nil {
+			return nil, err
+		}
+		record := make(map[string]interface{}, len(fields))
+		for i, field := range fields {
+			if field == csvNull {
+				record[r.columns[i]] = nil
+			} else {
+				record[r.columns[i]] = field
+			}
+		}
+		return record, nil
+	}
+
+	// A truncated stream means the archive was not closed, e.g. the run was interrupted;
+	// all synced batches before it are still readable
+	var record map[string]interface{}
+	if err := r.json.Decode(&record); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	return record, nil
+}
+
+// Close implements archiveReader
+func (r *fileArchiveReader) Close() error {
+	r.gz.Close()
+	return r.file.Close()
+}
+
+// tableArchiveReader reads records from an archive table one page at a time, so no cursor
+// is held open while restored records are inserted. Each page continues after the primary
+// key of the last record of the previous one, so reading stays linear in the archive size.
+type tableArchiveReader struct {
+	c        *Cleaner
+	table    string   // Quoted archive table
+	pk       []string // Primary key columns the records are ordered by
+	quotedPK []string
+	pageSize int
+	lastKey  []interface{} // Primary key of the last record read, nil before the first page
+	page     []map[string]interface{}
+	done     bool
+}
+
+// Next implements archiveReader
+func (r *tableArchiveReader) Next() (map[string]interface{}, error) {
+	if len(r.page) == 0 && !r.done {
+		if err := r.fetch(); err != nil {
+			return nil, err
+		}
+	}
+	if len(r.page) == 0 {
+		return nil, io.EOF
+	}
+	record := r.page[0]
+	r.page = r.page[1:]
+	return record, nil
+}
+
+// fetch reads the next page of records
+func (r *tableArchiveReader) fetch() error {
+	where, args := "1 = 1", []interface{}{}
+	if r.lastKey != nil {
+		where, args = r.c.keysetCondition(r.quotedPK, r.lastKey)
+	}
+	orderBy := strings.Join(r.quotedPK, ", ")
+	query := fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY %s LIMIT %d", r.table, where, orderBy, r.pageSize)
+	rows, err := r.c.db.Queryx(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		record := make(map[string]interface{})
+		if err := rows.MapScan(record); err != nil {
+			return err
+		}
+		r.page = append(r.page, record)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	r.done = len(r.page) < r.pageSize
+	if len(r.page) > 0 {
+		last := r.page[len(r.page)-1]
+		key := make([]interface{}, len(r.pk))
+		for i, column := range r.pk {
+			value, ok := last[column]
+			if !ok {
+				return fmt.Errorf("archived record has no primary key column %s", column)
+			}
+			key[i] = value
+		}
+		r.lastKey = cursorKey(key)
+	}
+	return nil
+}
+
+// Close implements archiveReader
+func (r *tableArchiveReader) Close() error {
+	return nil
+}
@@ -0,0 +1,134 @@
+package service
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// Runs cleaned by run_cascade are archived with their notes, which no preset cleans, and
+// both are restored from their archive tables
+func TestRestoreRunCascade(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+	c.config.Archive.Mode = models.ArchiveModeTable
+	dagRun := testTable(t, c, "dag_run")
+	dagRun.Strategy = models.StrategyRunCascade
+
+	if err := c.cleanRunCascade(dagRun); err != nil {
+		t.Fatalf("failed to clean table dag_run: %v", err)
+	}
+	checkCounts(t, db, map[string]int{"dag_run": 9, "dag_run_note": 9, "task_instance": 18, "xcom": 18})
+
+	// Notes have no date to filter them by
+	notes := archiveTableName("dag_run_note", c.startAt)
+	if _, err := c.Restore(RestoreOptions{Source: notes, From: time.Now().AddDate(0, 0, -60)}); err == nil {
+		t.Errorf("restored records of table dag_run_note filtered by date, expected an error")
+	}
+
+	for _, source := range []string{archiveTableName("dag_run", c.startAt), notes} {
+		result, err := c.Restore(RestoreOptions{Source: source})
+		if err != nil {
+			t.Fatalf("failed to restore %s: %v", source, err)
+		}
+		if result.Restored != 11 || result.Conflicts != 0 {
+			t.Errorf("restored %d records of %s with %d conflicts, expected 11 without conflict", result.Restored, source, result.Conflicts)
+		}
+	}
+	checkCounts(t, db, map[string]int{"dag_run": 20, "dag_run_note": 20})
+}
+
+// Logs archived to a file are restored in any format, filtered by DAG and date; restoring
+// the whole file again skips the records restored first as conflicts
+func TestRestoreFileArchive(t *testing.T) {
+	for _, format := range []string{models.ArchiveFormatJSONL, models.ArchiveFormatCSV} {
+		t.Run(format, func(t *testing.T) {
+			db := newTestDB(t)
+			seedTestDB(t, db)
+			c := newTestCleaner(t, db)
+			c.config.Archive.Mode = models.ArchiveModeFile
+			c.config.Archive.Format = format
+
+			if err := c.cleanTableByPK(testTable(t, c, "log")); err != nil {
+				t.Fatalf("failed to clean table log: %v", err)
+			}
+			if err := c.closeArchives(); err != nil {
+				t.Fatalf("failed to close archives: %v", err)
+			}
+			checkCounts(t, db, map[string]int{"log": 8})
+
+			// Logs of etl_daily 38 and 45 days old
+			now := time.Now()
+			source := filepath.Join(c.config.Archive.Directory, archiveFileName("log", c.startAt, format))
+			result, err := c.Restore(RestoreOptions{
+				Source: source,
+				DagID:  testDags[0],
+				From:   now.AddDate(0, 0, -50),
+				To:     now.AddDate(0, 0, -35),
+			})
+			if err != nil {
+				t.Fatalf("failed to restore %s: %v", source, err)
+			}
+			if result.Table != "log" || result.Read != 12 || result.Matched != 2 || result.Restored != 2 {
+				t.Errorf("restored %d of %d matched and %d read records into %s, expected 2 of 2 and 12 into log",
+					result.Restored, result.Matched, result.Read, result.Table)
+			}
+			checkCounts(t, db, map[string]int{"log": 10})
+
+			result, err = c.Restore(RestoreOptions{Source: source})
+			if err != nil {
+				t.Fatalf("failed to restore %s: %v", source, err)
+			}
+			if result.Restored != 10 || result.Conflicts != 2 {
+				t.Errorf("restored %d records with %d conflicts, expected 10 with 2 conflicts", result.Restored, result.Conflicts)
+			}
+			checkCounts(t, db, map[string]int{"log": 20})
+		})
+	}
+}
+
+// Task instances are read from their archive table in pages following the composite
+// primary key, and filtered by DAG and by their start date or its fallback
+func TestRestoreArchiveTableFilters(t *testing.T) {
+	db := newTestDB(t)
+	seedTestDB(t, db)
+	c := newTestCleaner(t, db)
+	c.config.Archive.Mode = models.ArchiveModeTable
+
+	if err := c.cleanTableByPK(testTable(t, c, "task_instance")); err != nil {
+		t.Fatalf("failed to clean table task_instance: %v", err)
+	}
+	checkCounts(t, db, map[string]int{"task_instance": 18})
+
+	// Task instances of the etl_daily runs 59 and 66 days old, the oldest dated by its
+	// queued_dttm as it never started
+	source := archiveTableName("task_instance", c.startAt)
+	now := time.Now()
+	result, err := c.Restore(RestoreOptions{
+		Source: source,
+		DagID:  testDags[0],
+		From:   now.AddDate(0, 0, -70),
+		To:     now.AddDate(0, 0, -55),
+	})
+	if err != nil {
+		t.Fatalf("failed to restore %s: %v", source, err)
+	}
+	if result.Read != 22 || result.Restored != 4 || result.Conflicts != 0 {
+		t.Errorf("restored %d of %d records read with %d conflicts, expected 4 of 22 without conflict",
+			result.Restored, result.Read, result.Conflicts)
+	}
+	checkCounts(t, db, map[string]int{"task_instance": 22})
+
+	result, err = c.Restore(RestoreOptions{Source: source})
+	if err != nil {
+		t.Fatalf("failed to restore %s: %v", source, err)
+	}
+	if result.Read != 22 || result.Restored != 18 || result.Conflicts != 4 {
+		t.Errorf("restored %d of %d records read with %d conflicts, expected 18 of 22 with 4 conflicts",
+			result.Restored, result.Read, result.Conflicts)
+	}
+	checkCounts(t, db, map[string]int{"task_instance": 40})
+}
@@ -0,0 +1,404 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// runDependentTables lists the Airflow tables holding records of DAG runs, children first.
+// Tables referencing dag_run by foreign key are added to them.
+var runDependentTables = []string{
+	"xcom",
+	"task_reschedule",
+	"task_fail",
+	"rendered_task_instance_fields",
+	"task_instance_note",
+	"task_map",
+	"task_instance_history",
+	"task_instance",
+	"dag_run_note",
+}
+
+// runDependent is a table whose records belong to DAG runs
+type runDependent struct {
+	table      string
+	columns    []string // Columns of the table identifying the run
+	runColumns []string // Matching columns of dag_run
+}
+
+// runDependents lists the existing tables whose records belong to DAG runs, children first.
+// Records are matched to their run by dag_id and run_id, or by their foreign key to dag_run.
+func (c *Cleaner) runDependents() ([]runDependent, error) {
+	graph, err := c.dependencies()
+	if err != nil {
+		return nil, err
+	}
+	existing, err := c.db.Tables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	exists := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		exists[name] = true
+	}
+
+	candidates := append([]string{}, runDependentTables...)
+	var referencing []string
+	for name := range graph.descendants(dagRunTable) {
+		referencing = append(referencing, name)
+	}
+	sort.Strings(referencing)
+	for _, name := range referencing {
+		known := false
+		for _, candidate := range candidates {
+			known = known || candidate == name
+		}
+		if !known {
+			candidates = append(candidates, name)
+		}
+	}
+
+	var tables []models.TableConfig
+	for _, name := range candidates {
+		if exists[name] {
+			tables = append(tables, models.TableConfig{TableName: name})
+		}
+	}
+
+	var dependents []runDependent
+	for _, table := range graph.cleaningOrder(tables) {
+		dependent, ok, err := c.runDependent(graph, table.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			log.Printf("Warning: Cannot match records of table %s to DAG runs, they are only deleted by cascade with the records they reference",
+				table.TableName)
+			continue
+		}
+		dependents = append(dependents, dependent)
+	}
+	return dependents, nil
+}
+
+// runDependent finds how the records of a table are matched to their DAG run
+func (c *Cleaner) runDependent(graph *dependencyGraph, table string) (runDependent, bool, error) {
+	runKey := []string{"dag_id", "run_id"}
+	hasRunKey := true
+	for _, column := range runKey {
+		exists, err := c.db.ColumnExists(table, column)
+		if err != nil {
+			return runDependent{}, false, fmt.Errorf("failed to check if column exists: %w", err)
+		}
+		hasRunKey = hasRunKey && exists
+	}
+	if hasRunKey {
+		return runDependent{table: table, columns: runKey, runColumns: runKey}, true, nil
+	}
+
+	for _, fk := range graph.children[dagRunTable] {
+		if fk.Table == table {
+			return runDependent{table: table, columns: fk.Columns, runColumns: fk.ReferencedColumns}, true, nil
+		}
+	}
+	return runDependent{}, false, nil
+}
+
+// planRunDependents counts the records of the dependent tables deleted with the DAG runs
+// matching condition. In dry run mode the expired records of the dependent tables cleaned
+// before are left out, they are counted for these tables.
+func (c *Cleaner) planRunDependents(condition string, args []interface{}, dryRun bool) ([]CascadePlan, error) {
+	dependents, err := c.runDependents()
+	if err != nil {
+		return nil, err
+	}
+
+	dagRun := c.db.Quote(dagRunTable)
+	var cascades []CascadePlan
+	for _, dependent := range dependents {
+		quoted := c.db.Quote(dependent.table)
+		join := make([]string, len(dependent.columns))
+		for i, column := range dependent.columns {
+			join[i] = fmt.Sprintf("%s.%s = %s.%s", dagRun, c.db.Quote(dependent.runColumns[i]), quoted, c.db.Quote(column))
+		}
+		where := fmt.Sprintf("EXISTS (SELECT 1 FROM %s WHERE %s AND (%s))", dagRun, strings.Join(join, " AND "), condition)
+		whereArgs := append([]interface{}{}, args...)
+
+		if dryRun {
+			expired, expiredArgs, err := c.expiredRecords(dependent.table)
+			if err != nil {
+				return nil, err
+			}
+			if expired != "" {
+				where += fmt.Sprintf(" AND CASE WHEN %s THEN 1 ELSE 0 END = 0", expired)
+				whereArgs = append(whereArgs, expiredArgs...)
+			}
+		}
+
+		cascade := CascadePlan{Table: dependent.table, Parent: dagRunTable, where: where, args: whereArgs}
+		countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", quoted, where)
+		if err := c.db.Get(&cascade.Count, countQuery, whereArgs...); err != nil {
+			return nil, fmt.Errorf("failed to count records of table %s: %w", dependent.table, err)
+		}
+		cascades = append(cascades, cascade)
+	}
+	return cascades, nil
+}
+
+// cleanRunCascade cleans expired DAG runs batch by batch, deleting all the records of
+// each batch of runs in the dependent tables, children first, before the runs themselves
+func (c *Cleaner) cleanRunCascade(table models.TableConfig) error {
+	log.Printf("Cleaning table %s with the records of its runs in dependent tables", table.TableName)
+	plan, err := c.planTable(table, c.config.DryRun)
+	if err != nil {
+		return err
+	}
+	if plan.Skipped != "" {
+		return nil
+	}
+
+	// If in dry run mode, stop here
+	if c.config.DryRun {
+		log.Printf("Dry run mode: No actual deletion operations will be performed")
+		return nil
+	}
+
+	// If there are no records to clean, return directly
+	count := plan.Count
+	if count == 0 {
+		log.Printf("No expired records need to be cleaned in table %s", table.TableName)
+		return nil
+	}
+
+	dependents, err := c.runDependents()
+	if err != nil {
+		return err
+	}
+	pk, err := c.primaryKey(table)
+	if err != nil {
+		return err
+	}
+
+	var deleted int
+	dependentDeleted := make(map[string]int)
+	batchSize := c.config.BatchSize
+	sleepDuration := time.Duration(c.config.SleepSeconds * float64(time.Second))
+	quotedPK := make([]string, len(pk))
+	for i, col := range pk {
+		quotedPK[i] = c.db.Quote(col)
+	}
+
+	// Create the archive tables before the transactions copying records to them
+	names := append(dependentNames(dependents), table.TableName)
+	archiveTables := make(map[string]string)
+	if c.config.Archive.Mode == models.ArchiveModeTable {
+		for _, name := range names {
+			if archiveTables[name], err = c.createArchiveTable(name); err != nil {
+				return fmt.Errorf("failed to create archive table: %w", err)
+			}
+		}
+	}
+
+	// Records deleted by cascade with the records of these tables, such as the task reschedules
+	// of Airflow 3 that reference task instances by ti_id, are archived before them
+	handled := make(map[string]bool, len(names))
+	for _, name := range names {
+		handled[name] = true
+	}
+	cascades := make(map[string][]cascadeArchive)
+	for _, name := range names {
+		if cascades[name], err = c.cascadeArchives(name, handled); err != nil {
+			return err
+		}
+	}
+
+	orderBy := strings.Join(quotedPK, ", ")
+	for _, scope := range plan.Scopes {
+		var scopeDeleted int
+		var lastKey []interface{}
+		for scopeDeleted < scope.Count {
+			currentBatchSize := batchSize
+			if scope.Count-scopeDeleted < batchSize {
+				currentBatchSize = scope.Count - scopeDeleted
+			}
+
+			startTime := time.Now()
+
+			// Select the runs of the batch, with the columns the dependent tables reference
+			// continuing after the last run of the previous batch
+			where, args := scope.where, scope.args
+			if lastKey != nil {
+				after, afterArgs := c.keysetCondition(quotedPK, lastKey)
+				where = fmt.Sprintf("(%s) AND %s", where, after)
+				args = append(append([]interface{}{}, args...), afterArgs...)
+			}
+			selectSQL := fmt.Sprintf("SELECT * FROM %s WHERE %s ORDER BY %s LIMIT %d",
+				c.db.Quote(table.TableName), where, orderBy, currentBatchSize)
+			batch, err := c.fetchBatch(selectSQL, pk, args...)
+			if err != nil {
+				return err
+			}
+			if len(batch.keys) == 0 {
+				break // No more records to delete
+			}
+			lastKey = cursorKey(batch.keys[len(batch.keys)-1])
+
+			// Archive the records of the batch before they are deleted
+			if c.config.Archive.Mode == models.ArchiveModeFile {
+				if err := c.archiveRunBatch(table.TableName, pk, dependents, cascades, batch); err != nil {
+					return err
+				}
+			}
+
+			// Delete the records of the dependent tables, then the runs, in one transaction
+			var batchDeleted int
+			err = c.db.Transaction(func(tx *database.Tx) error {
+				for _, dependent := range dependents {
+					keys, err := batch.values(dependent.runColumns)
+					if err != nil {
+						return err
+					}
+					if archiveTables[dependent.table] != "" {
+						if err := c.archiveRunCascades(tx, dependent.table, cascades[dependent.table], dependent.columns, keys); err != nil {
+							return err
+						}
+					}
+					n, err := c.deleteArchivedByKeys(tx, dependent.table, archiveTables[dependent.table], dependent.columns, keys)
+					if err != nil {
+						return fmt.Errorf("failed to delete records of table %s: %w", dependent.table, err)
+					}
+					dependentDeleted[dependent.table] += n
+				}
+				if archiveTables[table.TableName] != "" {
+					if err := c.archiveRunCascades(tx, table.TableName, cascades[table.TableName], pk, batch.keys); err != nil {
+						return err
+					}
+				}
+				n, err := c.deleteArchivedByKeys(tx, table.TableName, archiveTables[table.TableName], pk, batch.keys)
+				batchDeleted = n
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			scopeDeleted += batchDeleted
+			deleted += batchDeleted
+
+			batchDuration := time.Since(startTime)
+			log.Printf("Deleted %d/%d records from table %s with their dependent records (batch time: %.2fs)",
+				deleted, count, table.TableName, batchDuration.Seconds())
+
+			// If not finished deleting, sleep to reduce database pressure
+			if deleted < count {
+				log.Printf("Sleeping for %.3f seconds before continuing deletion...", c.config.SleepSeconds)
+				time.Sleep(sleepDuration)
+			}
+		}
+	}
+
+	for _, dependent := range dependents {
+		if n := dependentDeleted[dependent.table]; n > 0 {
+			log.Printf("Deleted %d records from table %s with the runs of table %s", n, dependent.table, table.TableName)
+		}
+	}
+	log.Printf("Successfully cleaned %d records from table %s", deleted, table.TableName)
+	return nil
+}
+
+// archiveRunBatch writes the records of a batch of runs and of their dependent tables, with
+// the records deleted by cascade with them, to the archive files
+func (c *Cleaner) archiveRunBatch(table string, pk []string, dependents []runDependent, cascades map[string][]cascadeArchive, batch *recordBatch) error {
+	for _, dependent := range dependents {
+		keys, err := batch.values(dependent.runColumns)
+		if err != nil {
+			return err
+		}
+		if err := c.archiveRunCascades(c.db, dependent.table, cascades[dependent.table], dependent.columns, keys); err != nil {
+			return err
+		}
+		quoted := make([]string, len(dependent.columns))
+		for i, column := range dependent.columns {
+			quoted[i] = c.db.Quote(column)
+		}
+
+		for _, cond := range c.keyConditions(quoted, keys) {
+			selectSQL := fmt.Sprintf("SELECT * FROM %s WHERE %s", c.db.Quote(dependent.table), cond.sql)
+			records, err := c.fetchBatch(selectSQL, nil, cond.args...)
+			if err != nil {
+				return err
+			}
+			if len(records.rows) == 0 {
+				continue
+			}
+			archive, err := c.tableArchive(dependent.table)
+			if err != nil {
+				return err
+			}
+			if err := archive.WriteBatch(records.columns, records.types, records.rows); err != nil {
+				return fmt.Errorf("failed to archive records of table %s: %w", dependent.table, err)
+			}
+		}
+	}
+
+	if err := c.archiveRunCascades(c.db, table, cascades[table], pk, batch.keys); err != nil {
+		return err
+	}
+	archive, err := c.tableArchive(table)
+	if err != nil {
+		return err
+	}
+	if err := archive.WriteBatch(batch.columns, batch.types, batch.rows); err != nil {
+		return fmt.Errorf("failed to archive records: %w", err)
+	}
+	return nil
+}
+
+// archiveRunCascades archives the records deleted by cascade with the records of a table
+// matching the given column values
+func (c *Cleaner) archiveRunCascades(db execer, table string, archives []cascadeArchive, columns []string, keys [][]interface{}) error {
+	if len(archives) == 0 {
+		return nil
+	}
+	qualified := make([]string, len(columns))
+	for i, column := range columns {
+		qualified[i] = c.db.Quote(table) + "." + c.db.Quote(column)
+	}
+	for _, cond := range c.keyConditions(qualified, keys) {
+		if err := c.archiveCascades(db, table, archives, cond.sql, cond.args); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteArchivedByKeys deletes the records of a table matching the given column values,
+// copying them to archiveTable first unless it is empty
+func (c *Cleaner) deleteArchivedByKeys(db execer, table, archiveTable string, columns []string, keys [][]interface{}) (int, error) {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = c.db.Quote(column)
+	}
+
+	if archiveTable != "" {
+		if err := c.copyByKeys(db, table, archiveTable, quoted, keys, "", nil); err != nil {
+			return 0, err
+		}
+	}
+	return c.deleteByKeys(db, table, quoted, keys, "", nil)
+}
+
+// dependentNames returns the table names of run dependents
+func dependentNames(dependents []runDependent) []string {
+	names := make([]string, len(dependents))
+	for i, dependent := range dependents {
+		names[i] = dependent.table
+	}
+	return names
+}
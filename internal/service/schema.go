@@ -0,0 +1,135 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+)
+
+// alembicRelease is the head migration of the metadata database of a range of Airflow releases
+type alembicRelease struct {
+	revision string
+	release  string // First Airflow release with this head revision
+}
+
+// alembicReleases lists the head revisions of the Airflow releases changing the metadata
+// schema, oldest first. A release range ends at the first release of the next entry.
+var alembicReleases = []alembicRelease{
+	{"e959f08ac86c", "2.0.0"},
+	{"82b7c48c147f", "2.0.1"},
+	{"2e42bb497a22", "2.0.2"},
+	{"a13f7613ad25", "2.1.0"},
+	{"97cdd93827b8", "2.1.3"},
+	{"ccde3e26fe78", "2.1.4"},
+	{"7b2661a43ba3", "2.2.0"},
+	{"be2bfac3da23", "2.2.3"},
+	{"587bdf053233", "2.2.4"},
+	{"b1b348e02d07", "2.3.0"},
+	{"1de7bc13c950", "2.3.1"},
+	{"3c94c427fdf6", "2.3.2"},
+	{"f5fcbda3e651", "2.3.3"},
+	{"ecb43d2a1842", "2.4.0"},
+	{"b0d31815b5a6", "2.4.2"},
+	{"e07f49787c9d", "2.4.3"},
+	{"290244fb8b83", "2.5.0"},
+	{"98ae134e6fff", "2.6.0"},
+	{"c804e5c76e3e", "2.6.2"},
+	{"405de8318b3a", "2.7.0"},
+	{"10b52ebd31f7", "2.8.0"},
+	{"88344c1d9134", "2.8.1"},
+	{"1949afb29106", "2.9.0"},
+	{"686269002441", "2.9.2"},
+	{"22ed7efa9da2", "2.10.0"},
+	{"5f2621c13b39", "2.10.3"},
+	{"29ce7909c52b", "3.0.0"},
+	{"fe199e1abd77", "3.0.3"},
+	{"cc92b33c6709", "3.1.0"},
+}
+
+// alembicTable holds the current migration revision of the Airflow metadata database
+const alembicTable = "alembic_version"
+
+// SchemaVersion describes the Airflow release range of the metadata database
+type SchemaVersion struct {
+	Revision string // Alembic revision of the database, empty when not read
+	Release  string // First Airflow release of the range, empty when unknown
+	Until    string // First Airflow release after the range, empty for the latest known range
+	Preset   string // Table preset matching the schema
+	Forced   bool   // Whether the preset was chosen despite an unknown revision
+}
+
+// String describes the version for the run header
+func (v *SchemaVersion) String() string {
+	switch {
+	case v.Release != "" && v.Until != "":
+		return fmt.Sprintf("Airflow %s or later, before %s (revision %s)", v.Release, v.Until, v.Revision)
+	case v.Release != "":
+		return fmt.Sprintf("Airflow %s or later (revision %s)", v.Release, v.Revision)
+	case v.Revision != "":
+		return fmt.Sprintf("unknown Airflow version (revision %s)", v.Revision)
+	default:
+		return "unknown Airflow version"
+	}
+}
+
+// DetectSchema reads the alembic revision of the metadata database and maps it to an Airflow
+// release range and the matching table preset. An unknown revision is an error unless force
+// is set, e.g. when the preset is configured, in which case the preset is guessed from the
+// columns of dag_run.
+func DetectSchema(db *database.DB, force bool) (*SchemaVersion, error) {
+	if db.IsMock() {
+		log.Printf("Mock mode: Skipping schema detection, using the %s preset", PresetAirflow2)
+		return &SchemaVersion{Preset: PresetAirflow2, Forced: true}, nil
+	}
+
+	version := &SchemaVersion{}
+	exists, err := db.TableExists(alembicTable)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if table exists: %w", err)
+	}
+	if exists {
+		var revisions []string
+		query := fmt.Sprintf("SELECT %s FROM %s", db.Quote("version_num"), db.Quote(alembicTable))
+		if err := db.Select(&revisions, query); err != nil {
+			return nil, fmt.Errorf("failed to read the schema revision: %w", err)
+		}
+		version.Revision = strings.Join(revisions, ",")
+		for i, known := range alembicReleases {
+			if len(revisions) == 1 && revisions[0] == known.revision {
+				version.Release = known.release
+				if i+1 < len(alembicReleases) {
+					version.Until = alembicReleases[i+1].release
+				}
+				version.Preset = PresetAirflow2
+				if strings.HasPrefix(known.release, "3.") {
+					version.Preset = PresetAirflow3
+				}
+			}
+		}
+	}
+	if version.Preset != "" {
+		return version, nil
+	}
+
+	if !force {
+		if !exists {
+			return nil, fmt.Errorf("table %s not found, not an Airflow 2.0+ metadata database; use --force-schema to clean it anyway", alembicTable)
+		}
+		return nil, fmt.Errorf("unknown schema revision %s, not a released Airflow 2.0+ version; use --force-schema to clean it anyway", version.Revision)
+	}
+
+	// Airflow 3 renamed the execution_date of DAG runs to logical_date
+	airflow3, err := db.ColumnExists(dagRunTable, "logical_date")
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if column exists: %w", err)
+	}
+	version.Preset = PresetAirflow2
+	if airflow3 {
+		version.Preset = PresetAirflow3
+	}
+	version.Forced = true
+	log.Printf("Warning: Unknown schema revision %q, the columns of %s match the %s preset", version.Revision, dagRunTable, version.Preset)
+	return version, nil
+}
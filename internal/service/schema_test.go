@@ -0,0 +1,37 @@
+package service
+
+import "testing"
+
+func TestDetectSchema(t *testing.T) {
+	tests := []struct {
+		revision string
+		force    bool
+		version  string
+		preset   string
+	}{
+		{"ecb43d2a1842", false, "Airflow 2.4.0 or later, before 2.4.2 (revision ecb43d2a1842)", PresetAirflow2},
+		{"e07f49787c9d", false, "Airflow 2.4.3 or later, before 2.5.0 (revision e07f49787c9d)", PresetAirflow2},
+		{"29ce7909c52b", false, "Airflow 3.0.0 or later, before 3.0.3 (revision 29ce7909c52b)", PresetAirflow3},
+		{"0123456789ab", false, "", ""},
+		{"0123456789ab", true, "unknown Airflow version (revision 0123456789ab)", PresetAirflow2},
+	}
+	for _, tt := range tests {
+		db := newTestDB(t)
+		mustExec(t, db, "CREATE TABLE alembic_version (version_num VARCHAR(32) NOT NULL PRIMARY KEY)")
+		mustExec(t, db, "INSERT INTO alembic_version (version_num) VALUES (?)", tt.revision)
+
+		version, err := DetectSchema(db, tt.force)
+		if tt.version == "" {
+			if err == nil {
+				t.Errorf("detected %s for revision %s, expected an error", version, tt.revision)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("failed to detect revision %s: %v", tt.revision, err)
+		}
+		if version.String() != tt.version || version.Preset != tt.preset {
+			t.Errorf("detected %s with the %s preset, expected %s with the %s preset", version, version.Preset, tt.version, tt.preset)
+		}
+	}
+}
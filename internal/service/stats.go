@@ -0,0 +1,138 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// AgeBuckets are the upper bounds in days of the age distribution buckets,
+// the last bucket holds the records older than the last bound
+var AgeBuckets = []int{7, 30, 90, 365}
+
+// TableStats describes the size and age distribution of a table
+type TableStats struct {
+	Table      string
+	Rows       int64
+	SizeBytes  int64 // Size of the table and its indexes, -1 when not supported
+	Expired    int64 // Records older than the retention period
+	NullDates  int64 // Records without date
+	Buckets    []int64
+	Oldest     time.Time
+	Newest     time.Time
+	DateColumn string
+	Skipped    string // Reason the table is skipped, empty otherwise
+}
+
+// Stats collects the size and age distribution of every enabled table
+func (c *Cleaner) Stats() ([]TableStats, error) {
+	// Mock mode makes up counts, it cannot describe the tables
+	if c.db.IsMock() {
+		return nil, fmt.Errorf("statistics are read from the database, they are not available in mock mode")
+	}
+
+	var stats []TableStats
+	for _, table := range c.config.Tables {
+		if !table.Enabled {
+			continue
+		}
+		tableStats, err := c.tableStats(table)
+		if err != nil {
+			return stats, fmt.Errorf("failed to get statistics of table %s: %w", table.TableName, err)
+		}
+		stats = append(stats, *tableStats)
+	}
+	return stats, nil
+}
+
+// tableStats collects the size and age distribution of a table
+func (c *Cleaner) tableStats(table models.TableConfig) (*TableStats, error) {
+	stats := &TableStats{Table: table.TableName, DateColumn: table.DateColumn}
+
+	exists, err := c.db.TableExists(table.TableName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if table exists: %w", err)
+	}
+	if !exists {
+		stats.Skipped = "table does not exist"
+		return stats, nil
+	}
+	dateTable := dateTableName(table)
+	columnExists, err := c.db.ColumnExists(dateTable, table.DateColumn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if column exists: %w", err)
+	}
+	if !columnExists {
+		stats.Skipped = fmt.Sprintf("column %s does not exist in table %s", table.DateColumn, dateTable)
+		return stats, nil
+	}
+
+	if stats.SizeBytes, err = c.db.TableSize(table.TableName); err != nil {
+		return nil, fmt.Errorf("failed to get table size: %w", err)
+	}
+
+	// Records are expired in any retention scope
+	now := time.Now()
+	scopes, err := c.retentionScopes(table, now)
+	if err != nil {
+		return nil, err
+	}
+	expired, args := combineScopes(scopes)
+
+	// Count records per age bucket in a single scan
+	date, err := c.dateExpression(table)
+	if err != nil {
+		return nil, err
+	}
+	columns := []string{
+		"COUNT(*)",
+		fmt.Sprintf("COALESCE(SUM(CASE WHEN %s IS NULL THEN 1 ELSE 0 END), 0)", date),
+		fmt.Sprintf("COALESCE(SUM(CASE WHEN %s THEN 1 ELSE 0 END), 0)", expired),
+	}
+	for i, days := range AgeBuckets {
+		if i == 0 {
+			columns = append(columns, fmt.Sprintf("COALESCE(SUM(CASE WHEN %s >= ? THEN 1 ELSE 0 END), 0)", date))
+			args = append(args, now.AddDate(0, 0, -days))
+			continue
+		}
+		columns = append(columns, fmt.Sprintf("COALESCE(SUM(CASE WHEN %s < ? AND %s >= ? THEN 1 ELSE 0 END), 0)", date, date))
+		args = append(args, now.AddDate(0, 0, -AgeBuckets[i-1]), now.AddDate(0, 0, -days))
+	}
+	columns = append(columns, fmt.Sprintf("COALESCE(SUM(CASE WHEN %s < ? THEN 1 ELSE 0 END), 0)", date))
+	args = append(args, now.AddDate(0, 0, -AgeBuckets[len(AgeBuckets)-1]))
+	columns = append(columns, fmt.Sprintf("MIN(%s)", date), fmt.Sprintf("MAX(%s)", date))
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), c.db.Quote(table.TableName))
+	rows, err := c.db.Queryx(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get age distribution: %w", err)
+	}
+	defer rows.Close()
+
+	stats.Buckets = make([]int64, len(AgeBuckets)+1)
+	var oldest, newest interface{}
+	dest := []interface{}{&stats.Rows, &stats.NullDates, &stats.Expired}
+	for i := range stats.Buckets {
+		dest = append(dest, &stats.Buckets[i])
+	}
+	dest = append(dest, &oldest, &newest)
+
+	if rows.Next() {
+		if err := rows.Scan(dest...); err != nil {
+			return nil, fmt.Errorf("failed to scan age distribution: %w", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read age distribution: %w", err)
+	}
+
+	if stats.Oldest, err = timeValue(oldest); err != nil {
+		return nil, err
+	}
+	if stats.Newest, err = timeValue(newest); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,366 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// Built-in table presets, auto chooses the preset from the schema of the database
+const (
+	PresetAuto     = "auto"
+	PresetAirflow2 = "airflow2"
+	PresetAirflow3 = "airflow3"
+	PresetNone     = "none"
+)
+
+// Unfinished states of DAG runs and task instances, never cleaned by the built-in presets
+var (
+	unfinishedDagRunStates = []string{"queued", "running"}
+	unfinishedTaskStates   = []string{"scheduled", "queued", "running", "up_for_retry", "up_for_reschedule", "restarting", "deferred"}
+)
+
+// Fallback date columns of the records without date: task instances that never started,
+// e.g. upstream_failed or skipped ones, and jobs that crashed without end date
+var (
+	taskFallbackDates = []string{"queued_dttm", "updated_at"}
+	jobFallbackDates  = []string{"latest_heartbeat"}
+)
+
+// runDateJoin takes the date of the records of a DAG run from the run, so that they are
+// cleaned with it and kept with the runs dag_run never cleans
+var runDateJoin = &models.DateJoin{Table: "dag_run", Columns: []string{"dag_id", "run_id"}}
+
+// Data-aware scheduling tables. Associations between events and DAG runs or aliases are
+// dated by their event and cleaned before it. Events still queued for a pending DAG run,
+// i.e. not older than the queue record of their dataset, are never cleaned.
+var (
+	datasetEventJoin = &models.DateJoin{Table: "dataset_event", Columns: []string{"event_id"}, ReferencedColumns: []string{"id"}}
+	datasetTables    = []models.TableConfig{
+		{TableName: "dagrun_dataset_event", DateColumn: "timestamp", DateJoin: datasetEventJoin,
+			Condition: pendingEventCondition("dagrun_dataset_event", "dataset_event", "dataset_dag_run_queue", "dataset_id")},
+		{TableName: "dataset_alias_dataset_event", DateColumn: "timestamp", DateJoin: datasetEventJoin,
+			Condition: pendingEventCondition("dataset_alias_dataset_event", "dataset_event", "dataset_dag_run_queue", "dataset_id")},
+		{TableName: "dataset_event", DateColumn: "timestamp",
+			Condition: pendingEventCondition("", "dataset_event", "dataset_dag_run_queue", "dataset_id")},
+	}
+
+	assetEventJoin = &models.DateJoin{Table: "asset_event", Columns: []string{"event_id"}, ReferencedColumns: []string{"id"}}
+	assetTables    = []models.TableConfig{
+		{TableName: "dagrun_asset_event", DateColumn: "timestamp", DateJoin: assetEventJoin,
+			Condition: pendingEventCondition("dagrun_asset_event", "asset_event", "asset_dag_run_queue", "asset_id")},
+		{TableName: "asset_alias_asset_event", DateColumn: "timestamp", DateJoin: assetEventJoin,
+			Condition: pendingEventCondition("asset_alias_asset_event", "asset_event", "asset_dag_run_queue", "asset_id")},
+		{TableName: "asset_event", DateColumn: "timestamp",
+			Condition: pendingEventCondition("", "asset_event", "asset_dag_run_queue", "asset_id")},
+	}
+)
+
+// Airflow 3 tables. Backfills are dated by their completion, running backfills are never
+// cleaned, nor backfills whose DAG runs are not cleaned yet.
+var backfillJoin = &models.DateJoin{Table: "backfill", Columns: []string{"backfill_id"}, ReferencedColumns: []string{"id"}}
+
+// staleDagVersionCondition keeps the latest version of each DAG and the versions still
+// referenced by DAG runs or task instances. The latest versions are selected in a grouped
+// derived table, which MySQL materializes before deleting from dag_version.
+const staleDagVersionCondition = "EXISTS (SELECT 1 FROM (SELECT dag_id, MAX(version_number) AS latest FROM dag_version GROUP BY dag_id) latest_versions " +
+	"WHERE latest_versions.dag_id = dag_version.dag_id AND latest_versions.latest > dag_version.version_number) " +
+	"AND NOT EXISTS (SELECT 1 FROM dag_run r WHERE r.created_dag_version_id = dag_version.id) " +
+	"AND NOT EXISTS (SELECT 1 FROM task_instance ti WHERE ti.dag_version_id = dag_version.id) " +
+	"AND NOT EXISTS (SELECT 1 FROM task_instance_history tih WHERE tih.dag_version_id = dag_version.id)"
+
+// pendingEventCondition builds the condition leaving out the events queued for a pending DAG run,
+// for the event table itself or, when association is set, for an association table referencing
+// the events by event_id. Identifiers are left unquoted, they are valid as is on all databases.
+func pendingEventCondition(association, events, queue, column string) string {
+	// Events are referenced by the name of the cleaned event table, or by their alias in the
+	// subquery of an association table
+	pending := func(event string) string {
+		return fmt.Sprintf("SELECT 1 FROM %s q WHERE q.%s = %s.%s AND q.created_at <= %s.timestamp", queue, column, event, column, event)
+	}
+	if association == "" {
+		return fmt.Sprintf("NOT EXISTS (%s)", pending(events))
+	}
+	return fmt.Sprintf("NOT EXISTS (SELECT 1 FROM %s e WHERE e.id = %s.event_id AND EXISTS (%s))", events, association, pending("e"))
+}
+
+// builtinTables lists the tables cleaned by each preset, in cleaning order.
+// Retention days are filled in from the configuration, defaulting to the dag_run retention.
+var builtinTables = map[string][]models.TableConfig{
+	PresetAirflow2: concatTables([]models.TableConfig{
+		{TableName: "dag_run", DateColumn: "execution_date", ExcludedStates: unfinishedDagRunStates},
+		{TableName: "task_instance", DateColumn: "start_date", FallbackDateColumns: taskFallbackDates, ExcludedStates: unfinishedTaskStates},
+		{TableName: "xcom", DateColumn: "timestamp"},
+		{TableName: "log", DateColumn: "dttm"},
+		{TableName: "job", DateColumn: "end_date", FallbackDateColumns: jobFallbackDates},
+		{TableName: "rendered_task_instance_fields", DateColumn: "execution_date", DateJoin: runDateJoin},
+		{TableName: "task_reschedule", DateColumn: "execution_date", DateJoin: runDateJoin},
+		{TableName: "task_fail", DateColumn: "execution_date", DateJoin: runDateJoin},
+		{TableName: "sla_miss", DateColumn: "timestamp"},
+		{TableName: "import_error", DateColumn: "timestamp"},
+		{TableName: "callback_request", DateColumn: "created_at"},
+		{TableName: "dag_warning", DateColumn: "timestamp"},
+	}, datasetTables),
+	PresetAirflow3: concatTables([]models.TableConfig{
+		{TableName: "dag_run", DateColumn: "logical_date", FallbackDateColumns: []string{"run_after"}, ExcludedStates: unfinishedDagRunStates},
+		{TableName: "task_instance", DateColumn: "start_date", FallbackDateColumns: taskFallbackDates, ExcludedStates: unfinishedTaskStates},
+		{TableName: "task_instance_history", DateColumn: "start_date", FallbackDateColumns: taskFallbackDates},
+		{TableName: "xcom", DateColumn: "timestamp"},
+		{TableName: "log", DateColumn: "dttm"},
+		{TableName: "job", DateColumn: "end_date", FallbackDateColumns: jobFallbackDates},
+		{TableName: "rendered_task_instance_fields", DateColumn: "logical_date", FallbackDateColumns: []string{"run_after"}, DateJoin: runDateJoin},
+		{TableName: "task_reschedule", DateColumn: "start_date"},
+		{TableName: "import_error", DateColumn: "timestamp"},
+		{TableName: "callback_request", DateColumn: "created_at"},
+		{TableName: "dag_warning", DateColumn: "timestamp"},
+		{TableName: "backfill_dag_run", DateColumn: "completed_at", DateJoin: backfillJoin,
+			Condition: "NOT EXISTS (SELECT 1 FROM dag_run r WHERE r.backfill_id = backfill_dag_run.backfill_id)"},
+		{TableName: "backfill", DateColumn: "completed_at",
+			Condition: "NOT EXISTS (SELECT 1 FROM dag_run r WHERE r.backfill_id = backfill.id)"},
+		{TableName: "dag_version", DateColumn: "created_at", Condition: staleDagVersionCondition},
+	}, assetTables),
+	PresetNone: nil,
+}
+
+// concatTables concatenates lists of table configurations
+func concatTables(lists ...[]models.TableConfig) []models.TableConfig {
+	var tables []models.TableConfig
+	for _, list := range lists {
+		tables = append(tables, list...)
+	}
+	return tables
+}
+
+// TableDefinition declares a table in the configuration file.
+// An entry whose name matches a preset table overrides only the fields it sets.
+type TableDefinition struct {
+	Name       string `yaml:"name"`
+	DateColumn string `yaml:"date_column"`
+	// Date columns used in order when date_column is NULL, replacing the preset ones
+	FallbackDateColumns []string `yaml:"fallback_date_columns"`
+	PrimaryKey          string   `yaml:"primary_key"` // Expected primary key, checked against the database
+	RetentionDays       int      `yaml:"retention_days"`
+	Enabled             *bool    `yaml:"enabled"`
+	// Retention days per value of the state column, e.g. {success: 14, failed: 90}
+	StateRetention map[string]int `yaml:"state_retention"`
+	// States never cleaned, replacing the preset ones; [] to clean every state
+	ExcludedStates []string `yaml:"excluded_states"`
+	// Cleaning strategy: empty for the date column, run_cascade for dag_run, pk_range for
+	// tables with an integer primary key, date_window to walk the expired dates window by window,
+	// copy_swap to copy the records to keep to a new table replacing the table
+	Strategy string `yaml:"strategy"`
+	// Length of the windows of the date_window strategy, e.g. 6h, one day when empty
+	DateWindow time.Duration `yaml:"date_window"`
+	// Table holding date_column, for tables without date column
+	DateJoin *DateJoinDefinition `yaml:"date_join"`
+	// Additional SQL condition expired records must match to be cleaned
+	Condition string `yaml:"condition"`
+}
+
+// DateJoinDefinition declares the table holding the date of the records of a table
+type DateJoinDefinition struct {
+	Table   string   `yaml:"table"`
+	Columns []string `yaml:"columns"` // Columns of the table matching the records of the joined table
+	// Matching columns of the joined table, the same names as columns when not set
+	References []string `yaml:"references"`
+}
+
+// dateJoin converts the definition, nil when not set
+func (def *DateJoinDefinition) dateJoin(table string) (*models.DateJoin, error) {
+	if def == nil {
+		return nil, nil
+	}
+	if def.Table == "" || len(def.Columns) == 0 {
+		return nil, fmt.Errorf("date_join of table %s needs a table and columns", table)
+	}
+	if len(def.References) != 0 && len(def.References) != len(def.Columns) {
+		return nil, fmt.Errorf("date_join of table %s needs as many references as columns", table)
+	}
+	return &models.DateJoin{Table: def.Table, Columns: def.Columns, ReferencedColumns: def.References}, nil
+}
+
+// resolveTables merges the table definitions into the preset tables.
+// Preset tables take their retention from retentionDays unless a definition overrides it.
+func resolveTables(preset string, retentionDays map[string]int, definitions []TableDefinition) ([]models.TableConfig, error) {
+	presetTables, ok := builtinTables[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown table preset %q", preset)
+	}
+
+	tables := make([]models.TableConfig, 0, len(presetTables)+len(definitions))
+	index := make(map[string]int)
+	inherited := make(map[string]bool) // Preset tables using the dag_run retention
+	for _, table := range presetTables {
+		table.RetentionDays = retentionDays[table.TableName]
+		if table.RetentionDays == 0 && table.TableName != dagRunTable {
+			table.RetentionDays = retentionDays[dagRunTable]
+			inherited[table.TableName] = true
+		}
+		table.Enabled = true
+		index[table.TableName] = len(tables)
+		tables = append(tables, table)
+	}
+
+	for _, def := range definitions {
+		name := strings.TrimSpace(def.Name)
+		if name == "" {
+			return nil, fmt.Errorf("table definition without name")
+		}
+
+		dateJoin, err := def.DateJoin.dateJoin(name)
+		if err != nil {
+			return nil, err
+		}
+
+		i, exists := index[name]
+		if !exists {
+			// New table, not part of the preset
+			if def.DateColumn == "" {
+				return nil, fmt.Errorf("date_column not specified for table %s", name)
+			}
+			retention := def.RetentionDays
+			if retention == 0 {
+				retention = retentionDays[name]
+			}
+			tables = append(tables, models.TableConfig{
+				TableName:           name,
+				RetentionDays:       retention,
+				DateColumn:          def.DateColumn,
+				FallbackDateColumns: def.FallbackDateColumns,
+				PrimaryKey:          def.PrimaryKey,
+				Enabled:             def.Enabled == nil || *def.Enabled,
+				StateRetention:      def.StateRetention,
+				ExcludedStates:      def.ExcludedStates,
+				Strategy:            def.Strategy,
+				DateWindow:          def.DateWindow,
+				DateJoin:            dateJoin,
+				Condition:           def.Condition,
+			})
+			index[name] = len(tables) - 1
+			continue
+		}
+
+		// Override preset table
+		table := &tables[i]
+		if def.DateColumn != "" {
+			table.DateColumn = def.DateColumn
+			table.DateJoin = dateJoin
+		} else if dateJoin != nil {
+			table.DateJoin = dateJoin
+		}
+		if def.FallbackDateColumns != nil {
+			table.FallbackDateColumns = def.FallbackDateColumns
+		}
+		if def.PrimaryKey != "" {
+			table.PrimaryKey = def.PrimaryKey
+		}
+		if def.RetentionDays != 0 {
+			table.RetentionDays = def.RetentionDays
+			delete(inherited, name)
+		}
+		if def.Enabled != nil {
+			table.Enabled = *def.Enabled
+		}
+		if def.StateRetention != nil {
+			table.StateRetention = def.StateRetention
+		}
+		if def.ExcludedStates != nil {
+			table.ExcludedStates = def.ExcludedStates
+		}
+		if def.Strategy != "" {
+			table.Strategy = def.Strategy
+		}
+		if def.DateWindow != 0 {
+			table.DateWindow = def.DateWindow
+		}
+		if def.Condition != "" {
+			table.Condition = def.Condition
+		}
+	}
+
+	var inheriting []string
+	for _, table := range tables {
+		if inherited[table.TableName] && table.Enabled && table.RetentionDays > 0 {
+			inheriting = append(inheriting, table.TableName)
+		}
+	}
+	if len(inheriting) > 0 {
+		log.Printf("Tables without retention days use the dag_run retention of %d days: %s",
+			retentionDays[dagRunTable], strings.Join(inheriting, ", "))
+	}
+
+	for _, table := range tables {
+		if table.Enabled && table.RetentionDays <= 0 {
+			return nil, fmt.Errorf("retention days for table %s must be greater than 0", table.TableName)
+		}
+		switch table.Strategy {
+		case models.StrategyDefault, models.StrategyPKRange, models.StrategyDateWindow, models.StrategyCopySwap:
+		case models.StrategyRunCascade:
+			if table.TableName != dagRunTable {
+				return nil, fmt.Errorf("strategy %s only applies to table %s", table.Strategy, dagRunTable)
+			}
+		default:
+			return nil, fmt.Errorf("unknown strategy %q for table %s", table.Strategy, table.TableName)
+		}
+		if table.DateWindow < 0 {
+			return nil, fmt.Errorf("date window of table %s must not be negative", table.TableName)
+		}
+		for state, days := range table.StateRetention {
+			if days <= 0 {
+				return nil, fmt.Errorf("retention days for state %s of table %s must be greater than 0", state, table.TableName)
+			}
+			for _, excluded := range table.ExcludedStates {
+				if state == excluded {
+					return nil, fmt.Errorf("state %s of table %s has a retention but is excluded", state, table.TableName)
+				}
+			}
+		}
+	}
+
+	return tables, nil
+}
+
+// DagOverrideDefinition declares per-table retention for the DAGs whose dag_id
+// matches a glob pattern in the configuration file
+type DagOverrideDefinition struct {
+	DagID         string         `yaml:"dag_id"`
+	RetentionDays map[string]int `yaml:"retention_days"`
+}
+
+// applyDagOverrides attaches the dag_id overrides to the tables they set retention for,
+// keeping the order of the definitions so that the first matching pattern wins
+func applyDagOverrides(tables []models.TableConfig, definitions []DagOverrideDefinition) error {
+	index := make(map[string]int, len(tables))
+	for i, table := range tables {
+		index[table.TableName] = i
+	}
+
+	for _, def := range definitions {
+		pattern := strings.TrimSpace(def.DagID)
+		if pattern == "" {
+			return fmt.Errorf("dag override without dag_id pattern")
+		}
+		if len(def.RetentionDays) == 0 {
+			return fmt.Errorf("no retention days for dag override %s", pattern)
+		}
+
+		for name, days := range def.RetentionDays {
+			_, ok := index[name]
+			if !ok {
+				return fmt.Errorf("table %s of dag override %s is not configured", name, pattern)
+			}
+			if days <= 0 {
+				return fmt.Errorf("retention days for table %s of dag override %s must be greater than 0", name, pattern)
+			}
+		}
+		for i := range tables {
+			if days, ok := def.RetentionDays[tables[i].TableName]; ok {
+				tables[i].DagOverrides = append(tables[i].DagOverrides, models.DagOverride{DagPattern: pattern, RetentionDays: days})
+			}
+		}
+	}
+	return nil
+}
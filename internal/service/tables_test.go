@@ -0,0 +1,257 @@
+package service
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// airflow3TestSchema is a subset of the Airflow 3 schema: runs have a logical_date, NULL for
+// asset-triggered runs, and a run_after date; task instances have an id primary key that
+// task reschedules reference, without dag_id and run_id
+var airflow3TestSchema = []string{
+	`CREATE TABLE dag_run (
+		id INTEGER NOT NULL PRIMARY KEY,
+		dag_id VARCHAR(250) NOT NULL,
+		logical_date TIMESTAMP,
+		run_after TIMESTAMP NOT NULL,
+		state VARCHAR(50),
+		run_id VARCHAR(250) NOT NULL,
+		start_date TIMESTAMP,
+		end_date TIMESTAMP,
+		UNIQUE (dag_id, run_id),
+		UNIQUE (dag_id, logical_date)
+	)`,
+	`CREATE TABLE task_instance (
+		id VARCHAR(36) NOT NULL PRIMARY KEY,
+		task_id VARCHAR(250) NOT NULL,
+		dag_id VARCHAR(250) NOT NULL,
+		run_id VARCHAR(250) NOT NULL,
+		map_index INTEGER DEFAULT -1 NOT NULL,
+		start_date TIMESTAMP,
+		end_date TIMESTAMP,
+		state VARCHAR(20),
+		queued_dttm TIMESTAMP,
+		updated_at TIMESTAMP,
+		UNIQUE (dag_id, task_id, run_id, map_index),
+		FOREIGN KEY (dag_id, run_id) REFERENCES dag_run (dag_id, run_id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE task_reschedule (
+		id INTEGER NOT NULL PRIMARY KEY,
+		ti_id VARCHAR(36) NOT NULL,
+		start_date TIMESTAMP NOT NULL,
+		end_date TIMESTAMP NOT NULL,
+		reschedule_date TIMESTAMP NOT NULL,
+		FOREIGN KEY (ti_id) REFERENCES task_instance (id) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE xcom (
+		dag_run_id INTEGER NOT NULL,
+		task_id VARCHAR(250) NOT NULL,
+		map_index INTEGER DEFAULT -1 NOT NULL,
+		"key" VARCHAR(512) NOT NULL,
+		dag_id VARCHAR(250) NOT NULL,
+		run_id VARCHAR(250) NOT NULL,
+		value TEXT,
+		timestamp TIMESTAMP NOT NULL,
+		PRIMARY KEY (dag_run_id, task_id, map_index, "key"),
+		FOREIGN KEY (dag_id, task_id, run_id, map_index)
+			REFERENCES task_instance (dag_id, task_id, run_id, map_index) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE rendered_task_instance_fields (
+		dag_id VARCHAR(250) NOT NULL,
+		task_id VARCHAR(250) NOT NULL,
+		run_id VARCHAR(250) NOT NULL,
+		map_index INTEGER DEFAULT -1 NOT NULL,
+		rendered_fields TEXT NOT NULL,
+		PRIMARY KEY (dag_id, task_id, run_id, map_index),
+		FOREIGN KEY (dag_id, task_id, run_id, map_index)
+			REFERENCES task_instance (dag_id, task_id, run_id, map_index) ON DELETE CASCADE
+	)`,
+	`CREATE TABLE asset_event (
+		id INTEGER NOT NULL PRIMARY KEY,
+		asset_id INTEGER NOT NULL,
+		timestamp TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE asset_dag_run_queue (
+		asset_id INTEGER NOT NULL,
+		target_dag_id VARCHAR(250) NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		PRIMARY KEY (asset_id, target_dag_id)
+	)`,
+	`CREATE TABLE dagrun_asset_event (
+		dag_run_id INTEGER NOT NULL,
+		event_id INTEGER NOT NULL,
+		PRIMARY KEY (dag_run_id, event_id),
+		FOREIGN KEY (dag_run_id) REFERENCES dag_run (id) ON DELETE CASCADE,
+		FOREIGN KEY (event_id) REFERENCES asset_event (id) ON DELETE CASCADE
+	)`,
+}
+
+// seedAirflow3TestDB fills the Airflow 3 test database like seedTestDB. The runs of the last
+// DAG are triggered by the asset events of the first DAG and have no logical_date; every task
+// instance was rescheduled once.
+func seedAirflow3TestDB(t *testing.T, db *database.DB) {
+	t.Helper()
+	now := time.Now()
+	var id int
+	for d, dag := range testDags {
+		for i := 0; i < testRuns; i++ {
+			id++
+			date := now.AddDate(0, 0, -testRunAge-7*i)
+			runID := fmt.Sprintf("scheduled__%d", i)
+			var logicalDate interface{} = date
+			if d == len(testDags)-1 {
+				logicalDate = nil
+				runID = fmt.Sprintf("asset_triggered__%d", i)
+			}
+			state, taskState := "success", "success"
+			if d == len(testDags)-1 && i == testRuns-2 {
+				state, taskState = "running", "running"
+			}
+			mustExec(t, db, "INSERT INTO dag_run (id, dag_id, logical_date, run_after, state, run_id, start_date) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				id, dag, logicalDate, date, state, runID, date)
+			if d == 0 {
+				mustExec(t, db, "INSERT INTO asset_event (id, asset_id, timestamp) VALUES (?, ?, ?)", id, 1, date)
+			} else {
+				mustExec(t, db, "INSERT INTO dagrun_asset_event (dag_run_id, event_id) VALUES (?, ?)", id, i+1)
+			}
+
+			for task := 0; task < testTasks; task++ {
+				tiID := fmt.Sprintf("%s/%s/task_%d", dag, runID, task)
+				taskID := fmt.Sprintf("task_%d", task)
+				var start interface{} = date
+				if d == 0 && i == testRuns-1 && task == 0 {
+					start = nil
+				}
+				mustExec(t, db, "INSERT INTO task_instance (id, task_id, dag_id, run_id, start_date, state, queued_dttm) VALUES (?, ?, ?, ?, ?, ?, ?)",
+					tiID, taskID, dag, runID, start, taskState, date)
+				mustExec(t, db, "INSERT INTO task_reschedule (ti_id, start_date, end_date, reschedule_date) VALUES (?, ?, ?, ?)",
+					tiID, date, date, date)
+				mustExec(t, db, `INSERT INTO xcom (dag_run_id, task_id, "key", dag_id, run_id, value, timestamp) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+					id, taskID, "return_value", dag, runID, `"ok"`, date)
+				mustExec(t, db, "INSERT INTO rendered_task_instance_fields (dag_id, task_id, run_id, rendered_fields) VALUES (?, ?, ?, ?)",
+					dag, taskID, runID, "{}")
+			}
+		}
+	}
+}
+
+// The airflow3 preset dates runs by logical_date or, for asset-triggered runs, run_after, and
+// task reschedules by their own start_date as they have no dag_id and run_id: 11 expired runs,
+// 22 expired task instances taking their reschedules with them, and 2 expired reschedules of
+// the running run. The 6 expired asset events are cleaned after their 6 associations.
+func TestCleanAirflow3Tables(t *testing.T) {
+	tests := []struct {
+		name    string
+		clean   func(*Cleaner, models.TableConfig) error
+		keyForm string
+	}{
+		{"delete limit", (*Cleaner).cleanTable, models.KeyFormRowIn},
+		{"primary key row_in", (*Cleaner).cleanTableByPK, models.KeyFormRowIn},
+		{"primary key or", (*Cleaner).cleanTableByPK, models.KeyFormOr},
+		{"date window", (*Cleaner).cleanTableByDateWindow, models.KeyFormRowIn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t, airflow3TestSchema)
+			seedAirflow3TestDB(t, db)
+			tables, err := resolveTables(PresetAirflow3, map[string]int{"dag_run": 30}, nil)
+			if err != nil {
+				t.Fatalf("failed to resolve tables: %v", err)
+			}
+			c := newTestCleaner(t, db)
+			c.config.Tables = tables
+			c.config.CompositeKeyForm = tt.keyForm
+
+			for _, name := range []string{"task_instance", "task_reschedule", "rendered_task_instance_fields", "dagrun_asset_event", "asset_event"} {
+				if err := tt.clean(c, testTable(t, c, name)); err != nil {
+					t.Fatalf("failed to clean table %s: %v", name, err)
+				}
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 20, "task_instance": 18, "xcom": 18, "task_reschedule": 16,
+				"rendered_task_instance_fields": 18, "dagrun_asset_event": 4, "asset_event": 4})
+			if n := countRows(t, db, "task_instance", "state = ?", "running"); n != testTasks {
+				t.Errorf("%d running task instances left, expected %d", n, testTasks)
+			}
+
+			if err := tt.clean(c, testTable(t, c, "dag_run")); err != nil {
+				t.Fatalf("failed to clean table dag_run: %v", err)
+			}
+			checkCounts(t, db, map[string]int{"dag_run": 9, "task_instance": 18, "task_reschedule": 16})
+			if n := countRows(t, db, "dag_run", "logical_date IS NULL"); n != 5 {
+				t.Errorf("%d asset-triggered runs left, expected the 4 recent ones and the running one", n)
+			}
+		})
+	}
+}
+
+// Expired events queued for a pending DAG run are kept with their association records, in
+// the dataset tables of Airflow 2 and the asset tables of Airflow 3
+func TestPendingEventCondition(t *testing.T) {
+	for _, tt := range []struct {
+		preset string
+		kind   string
+	}{{PresetAirflow2, "dataset"}, {PresetAirflow3, "asset"}} {
+		t.Run(tt.kind, func(t *testing.T) {
+			db := newTestDB(t)
+			events, queue, association := tt.kind+"_event", tt.kind+"_dag_run_queue", "dagrun_"+tt.kind+"_event"
+			mustExec(t, db, fmt.Sprintf(`CREATE TABLE %s (
+				id INTEGER NOT NULL PRIMARY KEY,
+				%s_id INTEGER NOT NULL,
+				timestamp TIMESTAMP NOT NULL
+			)`, events, tt.kind))
+			mustExec(t, db, fmt.Sprintf(`CREATE TABLE %s (
+				%s_id INTEGER NOT NULL,
+				target_dag_id VARCHAR(250) NOT NULL,
+				created_at TIMESTAMP NOT NULL,
+				PRIMARY KEY (%s_id, target_dag_id)
+			)`, queue, tt.kind, tt.kind))
+			mustExec(t, db, fmt.Sprintf(`CREATE TABLE %s (
+				dag_run_id INTEGER NOT NULL,
+				event_id INTEGER NOT NULL,
+				PRIMARY KEY (dag_run_id, event_id),
+				FOREIGN KEY (event_id) REFERENCES %s (id) ON DELETE CASCADE
+			)`, association, events))
+
+			// The first asset is queued for a DAG since 65 days: its event of 60 days ago is
+			// pending, the one of 70 days ago is not, nor the event of the second asset
+			now := time.Now()
+			for _, event := range []struct {
+				id, asset, age int
+			}{{1, 1, 70}, {2, 1, 60}, {3, 2, 60}, {4, 1, 10}} {
+				mustExec(t, db, fmt.Sprintf("INSERT INTO %s (id, %s_id, timestamp) VALUES (?, ?, ?)", events, tt.kind),
+					event.id, event.asset, now.AddDate(0, 0, -event.age))
+				mustExec(t, db, fmt.Sprintf("INSERT INTO %s (dag_run_id, event_id) VALUES (?, ?)", association), 1, event.id)
+			}
+			mustExec(t, db, fmt.Sprintf("INSERT INTO %s (%s_id, target_dag_id, created_at) VALUES (?, ?, ?)", queue, tt.kind),
+				1, "consumer", now.AddDate(0, 0, -65))
+
+			tables, err := resolveTables(tt.preset, map[string]int{"dag_run": 30}, nil)
+			if err != nil {
+				t.Fatalf("failed to resolve tables: %v", err)
+			}
+			c := newTestCleaner(t, db)
+			c.config.Tables = tables
+			for _, name := range []string{association, events} {
+				if err := c.cleanTableByPK(testTable(t, c, name)); err != nil {
+					t.Fatalf("failed to clean table %s: %v", name, err)
+				}
+			}
+
+			for _, table := range []struct {
+				name, column string
+			}{{events, "id"}, {association, "event_id"}} {
+				var kept []int
+				if err := db.Select(&kept, fmt.Sprintf("SELECT %s FROM %s ORDER BY %s", table.column, table.name, table.column)); err != nil {
+					t.Fatalf("failed to read table %s: %v", table.name, err)
+				}
+				if fmt.Sprint(kept) != "[2 4]" {
+					t.Errorf("kept events %v in table %s, expected the pending event 2 and the recent event 4", kept, table.name)
+				}
+			}
+		})
+	}
+}
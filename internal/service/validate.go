@@ -0,0 +1,62 @@
+package service
+
+import "fmt"
+
+// Validate checks that the enabled tables exist in the database with their date and
+// primary key columns, and returns the problems found
+func (c *Cleaner) Validate() ([]string, error) {
+	var problems []string
+	for _, table := range c.config.Tables {
+		if !table.Enabled {
+			continue
+		}
+
+		exists, err := c.db.TableExists(table.TableName)
+		if err != nil {
+			return problems, fmt.Errorf("failed to check if table %s exists: %w", table.TableName, err)
+		}
+		if !exists {
+			problems = append(problems, fmt.Sprintf("table %s does not exist", table.TableName))
+			continue
+		}
+
+		var columns []string
+		if table.DateJoin == nil {
+			columns = append(columns, table.DateColumn)
+		} else {
+			// The date comes from the matching record of the joined table
+			columns = append(columns, table.DateJoin.Columns...)
+			joinedColumns := append([]string{table.DateColumn}, table.DateJoin.ReferencedColumns...)
+			if len(table.DateJoin.ReferencedColumns) == 0 {
+				joinedColumns = append(joinedColumns, table.DateJoin.Columns...)
+			}
+			for _, column := range joinedColumns {
+				columnExists, err := c.db.ColumnExists(table.DateJoin.Table, column)
+				if err != nil {
+					return problems, fmt.Errorf("failed to check if column %s.%s exists: %w", table.DateJoin.Table, column, err)
+				}
+				if !columnExists {
+					problems = append(problems, fmt.Sprintf("column %s does not exist in table %s", column, table.DateJoin.Table))
+				}
+			}
+		}
+		pk, err := c.db.PrimaryKey(table.TableName)
+		if err != nil {
+			return problems, fmt.Errorf("failed to read primary key of table %s: %w", table.TableName, err)
+		}
+		if err := checkPrimaryKey(table, pk); err != nil {
+			problems = append(problems, err.Error())
+		}
+
+		for _, column := range columns {
+			columnExists, err := c.db.ColumnExists(table.TableName, column)
+			if err != nil {
+				return problems, fmt.Errorf("failed to check if column %s.%s exists: %w", table.TableName, column, err)
+			}
+			if !columnExists {
+				problems = append(problems, fmt.Sprintf("column %s does not exist in table %s", column, table.TableName))
+			}
+		}
+	}
+	return problems, nil
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// jobTable is the table of scheduler, triggerer and task runner jobs
+const jobTable = "job"
+
+// minZombieHeartbeatTimeout is the shortest heartbeat timeout accepted, well above the
+// heartbeat intervals of Airflow jobs, so that live jobs are never taken for zombies
+const minZombieHeartbeatTimeout = 5 * time.Minute
+
+// ZombiePlan describes the running jobs that stopped heartbeating
+type ZombiePlan struct {
+	Action string    // models.ZombieActionFail or models.ZombieActionDelete
+	Cutoff time.Time // Jobs whose latest heartbeat is older are zombies
+	Count  int
+
+	where string        // Condition matching the zombie jobs
+	args  []interface{} // Arguments of the condition
+}
+
+// zombieJobsEnabled reports whether the zombie job policy applies to a table
+func (c *Cleaner) zombieJobsEnabled(table models.TableConfig) bool {
+	return table.TableName == jobTable && c.config.ZombieJobs.HeartbeatTimeout > 0
+}
+
+// planZombieJobs counts the running jobs without end date whose latest heartbeat is older
+// than the heartbeat timeout. Jobs with a recent heartbeat never match. In dry run mode the
+// zombies deleted by the job retention anyway are left out of the deleted ones.
+func (c *Cleaner) planZombieJobs(table models.TableConfig, dryRun bool) (*ZombiePlan, error) {
+	policy := c.config.ZombieJobs
+	for _, column := range []string{"state", "end_date", "latest_heartbeat"} {
+		if err := c.requireColumn(table.TableName, column, "zombie jobs"); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &ZombiePlan{Action: policy.Action, Cutoff: time.Now().Add(-policy.HeartbeatTimeout)}
+	plan.where = fmt.Sprintf("%s = ? AND %s IS NULL AND %s < ?",
+		c.db.Quote("state"), c.db.Quote("end_date"), c.db.Quote("latest_heartbeat"))
+	plan.args = []interface{}{"running", plan.Cutoff}
+
+	where, args := plan.where, plan.args
+	if dryRun && policy.Action == models.ZombieActionDelete {
+		expired, expiredArgs, err := c.expiredRecords(table.TableName)
+		if err != nil {
+			return nil, err
+		}
+		if expired != "" {
+			where += fmt.Sprintf(" AND CASE WHEN %s THEN 1 ELSE 0 END = 0", expired)
+			args = append(append([]interface{}{}, args...), expiredArgs...)
+		}
+	}
+
+	countQuery := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", c.db.Quote(table.TableName), where)
+	if err := c.db.Get(&plan.Count, countQuery, args...); err != nil {
+		return nil, fmt.Errorf("failed to count zombie jobs: %w", err)
+	}
+	log.Printf("Found %d zombie jobs in table %s: running, with no heartbeat since %s",
+		plan.Count, table.TableName, plan.Cutoff.Format("2006-01-02 15:04"))
+	return plan, nil
+}
+
+// cleanZombieJobs fails or deletes the zombie jobs before the job table is cleaned.
+// Failed zombies end at their latest heartbeat and are then cleaned by the job retention.
+func (c *Cleaner) cleanZombieJobs(table models.TableConfig) error {
+	exists, err := c.db.TableExists(table.TableName)
+	if err != nil {
+		return fmt.Errorf("failed to check if table exists: %w", err)
+	}
+	if !exists {
+		return nil
+	}
+
+	plan, err := c.planZombieJobs(table, c.config.DryRun)
+	if err != nil {
+		return err
+	}
+	if c.config.DryRun {
+		log.Printf("Dry run mode: Zombie jobs are left untouched")
+		return nil
+	}
+	if plan.Count == 0 {
+		return nil
+	}
+
+	if plan.Action == models.ZombieActionFail {
+		updateSQL := fmt.Sprintf("UPDATE %s SET %s = ?, %s = %s WHERE %s", c.db.Quote(table.TableName),
+			c.db.Quote("state"), c.db.Quote("end_date"), c.db.Quote("latest_heartbeat"), plan.where)
+		result, err := c.db.Exec(updateSQL, append([]interface{}{"failed"}, plan.args...)...)
+		if err != nil {
+			return fmt.Errorf("failed to mark zombie jobs as failed: %w", err)
+		}
+		marked, _ := result.RowsAffected()
+		log.Printf("Marked %d zombie jobs of table %s as failed", marked, table.TableName)
+		return nil
+	}
+
+	// Delete the zombies like expired records, archiving them when enabled. Deletes by primary
+	// key check again that the jobs are running without recent heartbeat, as the fail action does.
+	scope := ScopePlan{State: "running", Cutoff: plan.Cutoff, Count: plan.Count, where: plan.where, args: plan.args, recheck: true}
+	zombies := &TablePlan{Table: table.TableName, Cutoff: plan.Cutoff, Count: plan.Count, Scopes: []ScopePlan{scope}}
+	log.Printf("Deleting %d zombie jobs from table %s", plan.Count, table.TableName)
+	var deleted int
+	if c.config.UsePrimaryKeyDelete || c.config.Archive.Mode != "" {
+		var pk []string
+		if pk, err = c.primaryKey(table); err != nil {
+			return err
+		}
+		var cascades []cascadeArchive
+		if cascades, err = c.cascadeArchives(table.TableName, nil); err != nil {
+			return err
+		}
+		deleted, err = c.deleteScopesByPK(table, zombies, pk, cascades)
+	} else {
+		deleted, err = c.deleteScopes(table, zombies)
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Deleted %d zombie jobs from table %s", deleted, table.TableName)
+	return nil
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zhoucq/airflow-db-cleaner/internal/database"
+	"github.com/zhoucq/airflow-db-cleaner/internal/models"
+)
+
+// seedJobs creates the job table with two zombie jobs, 1 and 4, a running job with a fresh
+// heartbeat and a finished one
+func seedJobs(t *testing.T, db *database.DB) {
+	t.Helper()
+	mustExec(t, db, `CREATE TABLE job (
+		id INTEGER NOT NULL PRIMARY KEY,
+		dag_id VARCHAR(250),
+		state VARCHAR(20),
+		job_type VARCHAR(30),
+		start_date TIMESTAMP,
+		end_date TIMESTAMP,
+		latest_heartbeat TIMESTAMP,
+		hostname VARCHAR(500)
+	)`)
+	now := time.Now()
+	for _, job := range []struct {
+		id        int
+		state     string
+		heartbeat time.Duration
+		ended     bool
+	}{{1, "running", 2 * time.Hour, false}, {2, "running", time.Minute, false}, {3, "success", 3 * time.Hour, true}, {4, "running", 3 * time.Hour, false}} {
+		var end interface{}
+		if job.ended {
+			end = now.Add(-job.heartbeat)
+		}
+		mustExec(t, db, "INSERT INTO job (id, state, job_type, start_date, end_date, latest_heartbeat) VALUES (?, ?, ?, ?, ?, ?)",
+			job.id, job.state, "SchedulerJob", now.AddDate(0, 0, -1), end, now.Add(-job.heartbeat))
+	}
+}
+
+// Zombie jobs fail at their latest heartbeat, the job with a fresh heartbeat keeps running
+func TestFailZombieJobs(t *testing.T) {
+	db := newTestDB(t)
+	seedJobs(t, db)
+	c := newTestCleaner(t, db)
+	c.config.ZombieJobs = models.ZombieJobPolicy{HeartbeatTimeout: 30 * time.Minute, Action: models.ZombieActionFail}
+
+	if err := c.cleanZombieJobs(testTable(t, c, "job")); err != nil {
+		t.Fatalf("failed to clean zombie jobs: %v", err)
+	}
+	if n := countRows(t, db, "job", "state = ? AND end_date = latest_heartbeat AND id IN (1, 4)", "failed"); n != 2 {
+		t.Errorf("%d zombie jobs failed at their latest heartbeat, expected 2", n)
+	}
+	if n := countRows(t, db, "job", "state = ? AND end_date IS NULL AND id = 2", "running"); n != 1 {
+		t.Errorf("job with a fresh heartbeat was not left running")
+	}
+	checkCounts(t, db, map[string]int{"job": 4})
+}
+
+// Zombie jobs are deleted by primary key only while they are still zombies: job 4, which
+// heartbeats once job 1 is deleted, is kept like the job with a fresh heartbeat
+func TestDeleteZombieJobs(t *testing.T) {
+	db := newTestDB(t)
+	seedJobs(t, db)
+	mustExec(t, db, `CREATE TRIGGER job_heartbeat AFTER DELETE ON job WHEN OLD.id = 1 BEGIN
+		UPDATE job SET latest_heartbeat = strftime('%Y-%m-%d %H:%M:%f', 'now') WHERE id = 4;
+	END`)
+	c := newTestCleaner(t, db)
+	c.config.UsePrimaryKeyDelete = true
+	c.config.KeyChunkSize = 1
+	c.config.ZombieJobs = models.ZombieJobPolicy{HeartbeatTimeout: 30 * time.Minute, Action: models.ZombieActionDelete}
+
+	if err := c.cleanZombieJobs(testTable(t, c, "job")); err != nil {
+		t.Fatalf("failed to clean zombie jobs: %v", err)
+	}
+	checkCounts(t, db, map[string]int{"job": 3})
+	if n := countRows(t, db, "job", "state = ? AND id IN (2, 4)", "running"); n != 2 {
+		t.Errorf("%d of the jobs with a fresh heartbeat left running, expected 2", n)
+	}
+}
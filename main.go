@@ -1,82 +1,62 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
-
-	"github.com/zhoucq/airflow-db-cleaner/internal/database"
-	"github.com/zhoucq/airflow-db-cleaner/internal/service"
+	"strings"
 )
 
-func main() {
-	// Parse command line arguments
-	configPath := flag.String("config", "config/config.yaml", "Configuration file path")
-	flag.Parse()
-
-	// Ensure the configuration file path is absolute
-	absConfigPath, err := filepath.Abs(*configPath)
-	if err != nil {
-		log.Fatalf("Unable to get absolute path of configuration file: %v", err)
-	}
-
-	// Check if file exists
-	if _, err := os.Stat(absConfigPath); os.IsNotExist(err) {
-		log.Fatalf("Configuration file does not exist: %s", absConfigPath)
-	}
-
-	// Load configuration
-	config, err := service.LoadConfig(absConfigPath)
-	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
-	}
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const usage = `Usage: airflow-db-cleaner <command> [flags]
+
+Commands:
+  plan          Show the number of records that would be cleaned, without deleting anything
+  run           Clean expired records (default when no command is given)
+  stats         Show table sizes and the age distribution of records
+  validate      Check the configuration and the database schema
+  schema-check  Compare the table models with the live schema: added, missing and retyped columns
+  archives      List or drop archive tables: archives list|drop [flags]
+  restore       Restore archived records: restore [flags] <archive file or table>
+  version       Print the version
+
+Run "airflow-db-cleaner <command> -h" to list the flags of a command.
+`
+
+// commands maps command names to their implementation
+var commands = map[string]func(args []string) error{
+	"plan":         planCommand,
+	"run":          runCommand,
+	"stats":        statsCommand,
+	"validate":     validateCommand,
+	"schema-check": schemaCheckCommand,
+	"archives":     archivesCommand,
+	"restore":      restoreCommand,
+	"version":      versionCommand,
+}
 
-	// Set log according to configuration
-	if config.Log.File != "" {
-		logFile, err := os.OpenFile(config.Log.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		if err != nil {
-			log.Fatalf("Unable to open log file: %v", err)
-		}
-		defer logFile.Close()
-		log.SetOutput(logFile)
+func main() {
+	// Without a command, run the clean as earlier versions did
+	args := os.Args[1:]
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
 	}
 
-	// Connect to database
-	db, err := database.New(config.GetDatabaseConfig())
-	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+	if name == "help" {
+		fmt.Print(usage)
+		return
 	}
-	defer db.Close()
 
-	// Create cleaner
-	cleaner := service.NewCleaner(db, config.GetCleanerConfig())
-
-	// Print run mode
-	if config.Cleaner.DryRun {
-		fmt.Println("=== Running in Dry Run mode ===")
-		fmt.Println("No actual deletion operations will be executed, only showing the number of records to be deleted")
-	} else {
-		fmt.Println("=== Running in Execution mode ===")
-		fmt.Println("Actual deletion operations will be executed, please ensure important data has been backed up")
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
 	}
 
-	// Print deletion method
-	if config.Cleaner.UsePrimaryKeyDelete {
-		fmt.Println("\n=== Using Primary Key-based deletion method ===")
-		fmt.Println("This method can be faster for large tables but may involve more queries")
-	} else {
-		fmt.Println("\n=== Using Direct DELETE method ===")
-		fmt.Println("This method is simpler but may be slower for large tables")
+	if err := command(args); err != nil {
+		log.Fatalf("Command %s failed: %v", name, err)
 	}
-
-	fmt.Println("\n=== Starting to clean expired data ===")
-
-	// Execute cleaning
-	if err := cleaner.CleanAll(); err != nil {
-		log.Fatalf("Failed to clean data: %v", err)
-	}
-
-	fmt.Println("=== Data cleaning completed ===")
 }